@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/ytpay/csi-nfs/pkg/nfs"
+)
+
+var importVolume nfs.StaticVolume
+
+var importCmd = &cobra.Command{
+	Use:   "import PATH...",
+	Short: "Print PersistentVolume manifests for existing NFS directories",
+	Long: `Print PersistentVolume manifests exposing existing directories of an NFS
+server as pre-provisioned volumes, the driver never deletes their data.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if importVolume.Name != "" && len(args) > 1 {
+			return fmt.Errorf("--pv-name requires a single path")
+		}
+		for i, path := range args {
+			v := importVolume
+			v.Path = path
+			manifest, err := v.Manifest(name)
+			if err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+			if i > 0 {
+				fmt.Println("---")
+			}
+			fmt.Print(manifest)
+		}
+		return nil
+	},
+}
+
+func init() {
+	importCmd.Flags().StringVar(&importVolume.Server, "server", "", "NFS Server Address")
+	_ = importCmd.MarkFlagRequired("server")
+	importCmd.Flags().StringVar(&importVolume.Name, "pv-name", "", "PersistentVolume name, derived from the directory name when empty")
+	importCmd.Flags().StringVar(&importVolume.Capacity, "capacity", "10Gi", "PersistentVolume capacity")
+	importCmd.Flags().StringSliceVar(&importVolume.AccessModes, "access-modes", []string{"ReadWriteMany"}, "PersistentVolume access modes")
+	importCmd.Flags().StringVar(&importVolume.StorageClass, "storage-class", "", "PersistentVolume storage class name")
+	importCmd.Flags().StringVar(&importVolume.MountOptions, "mount-options", "", "Comma separated NFS mount options")
+
+	rootCmd.AddCommand(importCmd)
+}
@@ -0,0 +1,25 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var retentionCmd = &cobra.Command{
+	Use:   "retention",
+	Short: "Report the snapshots expired by their retention policy",
+	Long: `Print the snapshots expired by their retention policy, the ones still
+referenced by a VolumeSnapshotContent are kept. Nothing is deleted, only the
+controller deletes expired snapshots since it serializes deletions with the
+incremental snapshots it takes. It runs within the cluster, e.g. through
+kubectl exec in the controller pod, with the flags of the driver.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return newDriver().RetentionReport(os.Stdout)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(retentionCmd)
+}
@@ -2,8 +2,10 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -30,12 +32,29 @@ var (
 	endpoint           string
 	nodeID             string
 	maxStorageCapacity string
+	shutdownTimeout    time.Duration
 
 	nfsServer            string
 	nfsSharePoint        string
 	nfsLocalMountPoint   string
 	nfsLocalMountOptions string
+	nfsVersions          string
 	nfsSnapshotPath      string
+	nfsExportMountDir    string
+	nfsExportIdleTimeout time.Duration
+	retentionInterval    time.Duration
+	backendsConfig       string
+
+	nodeMountMode      string
+	nodeDataDir        string
+	tlsTransport       string
+	nodeTopology       map[string]string
+	nodeTopologyLabels []string
+	mountTimeout       time.Duration
+
+	maxVolumesPerNode    int64
+	maxVolumesFromMounts bool
+	enforceAccessModes   bool
 
 	enableIdentityServer   bool
 	enableControllerServer bool
@@ -46,26 +65,59 @@ var rootCmd = &cobra.Command{
 	Use:     "csi-nfs",
 	Short:   "CSI based NFS driver",
 	Version: Version,
+	// nodeid is only required to run the driver, not by its subcommands
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if nodeID == "" {
+			return fmt.Errorf(`required flag(s) "nodeid" not set`)
+		}
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		nfs.NewCSIDriver(
-			name,
-			strings.TrimPrefix(Version, "v"),
-			nodeID,
-			endpoint,
-			maxStorageCapacity,
-			nfsServer,
-			nfsSharePoint,
-			nfsLocalMountPoint,
-			nfsLocalMountOptions,
-			nfsSnapshotPath,
-			enableIdentityServer,
-			enableControllerServer,
-			enableNodeServer,
-			debug,
-		).Run()
+		newDriver().Run()
 	},
 }
 
+// driver is the csi driver run by the root command and its subcommands.
+type driver interface {
+	Run()
+	RetentionReport(w io.Writer) error
+}
+
+// newDriver returns the driver configured by the flags.
+func newDriver() driver {
+	return nfs.NewCSIDriver(
+		name,
+		strings.TrimPrefix(Version, "v"),
+		nodeID,
+		endpoint,
+		maxStorageCapacity,
+		nfsServer,
+		nfsSharePoint,
+		nfsLocalMountPoint,
+		nfsLocalMountOptions,
+		nfsVersions,
+		nfsSnapshotPath,
+		nfsExportMountDir,
+		backendsConfig,
+		nodeMountMode,
+		nodeDataDir,
+		tlsTransport,
+		nodeTopology,
+		nodeTopologyLabels,
+		maxVolumesPerNode,
+		maxVolumesFromMounts,
+		enforceAccessModes,
+		nfsExportIdleTimeout,
+		retentionInterval,
+		mountTimeout,
+		shutdownTimeout,
+		enableIdentityServer,
+		enableControllerServer,
+		enableNodeServer,
+		debug,
+	)
+}
+
 func init() {
 	cobra.OnInitialize(initLog)
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "Enable debug log")
@@ -75,10 +127,9 @@ func init() {
 	rootCmd.PersistentFlags().BoolVar(&enableNodeServer, "enable-node-server", false, "Enable Node gRPC Server")
 
 	rootCmd.PersistentFlags().StringVar(&nodeID, "nodeid", "", "CSI Node ID")
-	_ = rootCmd.MarkPersistentFlagRequired("nodeid")
-
 	rootCmd.PersistentFlags().StringVar(&endpoint, "endpoint", "unix:///csi/csi.sock", "CSI gRPC Server Endpoint")
-	_ = rootCmd.MarkPersistentFlagRequired("endpoint")
+
+	rootCmd.PersistentFlags().DurationVar(&shutdownTimeout, "shutdown-timeout", 20*time.Second, "Time to wait for in-flight gRPC calls before forcing shutdown")
 
 	rootCmd.PersistentFlags().StringVar(&name, "name", "csi-nfs", "CSI Driver Name")
 	_ = rootCmd.PersistentFlags().MarkHidden("name")
@@ -87,7 +138,21 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&nfsSharePoint, "nfs-server-share-point", "/", "NFS Server Share Point")
 	rootCmd.PersistentFlags().StringVar(&nfsLocalMountPoint, "nfs-local-mount-point", "/nfs", "NFS Local Mount Point")
 	rootCmd.PersistentFlags().StringVar(&nfsLocalMountOptions, "nfs-local-mount-options", "rw,vers=4,soft,timeo=10,retry=3", "NFS Local Mount Options")
+	rootCmd.PersistentFlags().StringVar(&nfsVersions, "nfs-versions", "", "Comma separated NFS versions to negotiate in order of preference when mount options set none, e.g. 4.2,4.1,4,3")
 	rootCmd.PersistentFlags().StringVar(&nfsSnapshotPath, "nfs-local-snapshot-mount-point", "/snapshot", "NFS Local Snapshot Mount Point")
+	rootCmd.PersistentFlags().StringVar(&nfsExportMountDir, "nfs-local-export-mount-dir", "/exports", "Directory where NFS exports from StorageClass parameters are mounted")
+	rootCmd.PersistentFlags().DurationVar(&nfsExportIdleTimeout, "nfs-local-export-idle-timeout", 5*time.Minute, "Unmount NFS exports from StorageClass parameters after being idle for this duration")
+	rootCmd.PersistentFlags().DurationVar(&retentionInterval, "snapshot-retention-interval", time.Hour, "Interval of the deletion of the snapshots expired by their retention policy, 0 disables it")
+	rootCmd.PersistentFlags().StringVar(&backendsConfig, "backends-config", "", "JSON file listing the NFS backends volumes are provisioned on by topology, an array of {name, server, share, mountOptions, topology, retention}")
+	rootCmd.PersistentFlags().StringToStringVar(&nodeTopology, "node-topology", nil, "Topology segments of the node, e.g. topology.csi-nfs/zone=zone-a")
+	rootCmd.PersistentFlags().StringSliceVar(&nodeTopologyLabels, "node-topology-labels", nil, "Labels of the node read from the API used as its topology segments, e.g. topology.kubernetes.io/zone")
+	rootCmd.PersistentFlags().Int64Var(&maxVolumesPerNode, "max-volumes-per-node", 0, "Maximum number of volumes published on a node, 0 means no limit")
+	rootCmd.PersistentFlags().BoolVar(&maxVolumesFromMounts, "max-volumes-per-node-from-mounts", false, "Cap the maximum number of volumes of a node by the mounts /proc/sys/fs/mount-max leaves room for")
+	rootCmd.PersistentFlags().BoolVar(&enforceAccessModes, "enforce-access-modes", false, "Record the nodes volumes are published on and reject publishing single-node volumes to a second node, requires the external-attacher")
+	rootCmd.PersistentFlags().StringVar(&nodeMountMode, "node-mount-mode", "direct", "Node mount mode: direct mounts the export at every pod, stage mounts it once per volume and node, shared mounts every export once per node, both then bind mount it into pods")
+	rootCmd.PersistentFlags().DurationVar(&mountTimeout, "mount-timeout", time.Minute, "Timeout of node mount and unmount operations, 0 disables it")
+	rootCmd.PersistentFlags().StringVar(&nodeDataDir, "node-data-dir", "/var/lib/csi-nfs", "Node directory for shared NFS export mounts, must be shared with the host")
+	rootCmd.PersistentFlags().StringVar(&tlsTransport, "tls-transport", "auto", "How the node encrypts volumes with a tls or mtls transport: kernel mounts with xprtsec, tunnel mounts through a local stunnel per server, auto uses kernel when supported")
 	rootCmd.PersistentFlags().StringVar(&maxStorageCapacity, "max-storage-capacity", "50G", "Volume Max Storage Capacity")
 
 	rootCmd.SetVersionTemplate(fmt.Sprintf(versionTpl, name, Version, runtime.GOOS+"/"+runtime.GOARCH, BuildDate, CommitID))
@@ -0,0 +1,60 @@
+package nfs
+
+import (
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// supportedAccessModes are the access modes of the volumes of this driver,
+// nfs itself does not restrict nodes nor writers.
+var supportedAccessModes = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+}
+
+// isReadOnlyAccessMode reports whether volumes are mounted read-only in
+// the access mode.
+func isReadOnlyAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+}
+
+// validateVolumeCapability verifies the driver supports a volume
+// capability, only mount volumes are.
+func (n *nfsDriver) validateVolumeCapability(c *csi.VolumeCapability) error {
+	if c == nil {
+		return fmt.Errorf("volume capability is empty")
+	}
+	if c.GetMount() == nil {
+		return fmt.Errorf("volume capability access type must be mount")
+	}
+	if c.GetAccessMode() == nil {
+		return fmt.Errorf("volume capability access mode is missing")
+	}
+	mode := c.GetAccessMode().GetMode()
+	for _, m := range n.cap {
+		if m.GetMode() == mode {
+			return checkMountOptions(c.GetMount().GetMountFlags())
+		}
+	}
+	return fmt.Errorf("access mode %s is not supported", mode)
+}
+
+// isSingleNodeAccessMode reports whether a volume may only be published
+// on a single node at a time in the access mode.
+func isSingleNodeAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:
+		return true
+	}
+	return false
+}
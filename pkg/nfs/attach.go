@@ -0,0 +1,262 @@
+package nfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// shareDataDir holds the driver data stored in the snapshot directory
+	// of an export, apart from the snapshots.
+	shareDataDir = ".csi-nfs"
+	// attachmentsDir holds the attachment record of every published volume.
+	attachmentsDir = shareDataDir + "/attachments"
+)
+
+// attachment is a publish of a volume on a node.
+type attachment struct {
+	AccessMode string `json:"accessMode"`
+	Readonly   bool   `json:"readonly"`
+}
+
+// attachmentRecord lists the nodes a volume is published on, it is stored
+// in the snapshot directory of an export so that it survives controller
+// restarts and failovers.
+type attachmentRecord struct {
+	VolumeID string                `json:"volumeId"`
+	Nodes    map[string]attachment `json:"nodes"`
+}
+
+// conflict returns why a volume holding the attachments of r cannot be
+// published on node in mode.
+func (r *attachmentRecord) conflict(node string, mode csi.VolumeCapability_AccessMode_Mode, readonly bool) error {
+	for other, a := range r.Nodes {
+		if other == node {
+			continue
+		}
+		otherMode := csi.VolumeCapability_AccessMode_Mode(csi.VolumeCapability_AccessMode_Mode_value[a.AccessMode])
+		if isSingleNodeAccessMode(mode) || isSingleNodeAccessMode(otherMode) {
+			return fmt.Errorf("volume %s is published on node %s in access mode %s", r.VolumeID, other, a.AccessMode)
+		}
+		singleWriter := mode == csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER ||
+			otherMode == csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER
+		if singleWriter && !readonly && !a.Readonly {
+			return fmt.Errorf("volume %s is published read-write on node %s", r.VolumeID, other)
+		}
+	}
+	return nil
+}
+
+func (cs *ControllerServer) ControllerPublishVolume(_ context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if !cs.Driver.enforceAccessModes {
+		return nil, status.Error(codes.Unimplemented, "Unimplemented ControllerPublishVolume")
+	}
+	logrus.Infof("ControllerPublishVolume: volume id: %s node id: %s", req.GetVolumeId(), req.GetNodeId())
+
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	nodeID := req.GetNodeId()
+	if nodeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Node ID missing in request")
+	}
+	if err := cs.Driver.validateVolumeCapability(req.GetVolumeCapability()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	vol, err := cs.Driver.parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	volPath, release, err := cs.volumePath(vol)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if _, err := os.Stat(volPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume %q does not exist", req.GetVolumeId())
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	cs.attachMu.Lock()
+	defer cs.attachMu.Unlock()
+
+	recordPath, releaseRecord, err := cs.attachmentPath(vol)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseRecord()
+	record, err := readAttachments(recordPath, vol.id)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	mode := req.GetVolumeCapability().GetAccessMode().GetMode()
+	want := attachment{
+		AccessMode: mode.String(),
+		Readonly:   req.GetReadonly() || isReadOnlyAccessMode(mode),
+	}
+	if a, ok := record.Nodes[nodeID]; ok {
+		if a != want {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s is already published on node %s in access mode %s (readonly %t)", vol.id, nodeID, a.AccessMode, a.Readonly)
+		}
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+	if err := record.conflict(nodeID, mode, want.Readonly); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	record.Nodes[nodeID] = want
+	if err := writeAttachments(recordPath, record); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	logrus.Infof("ControllerPublishVolume: volume %s published on node %s in access mode %s", vol.id, nodeID, want.AccessMode)
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+func (cs *ControllerServer) ControllerUnpublishVolume(_ context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if !cs.Driver.enforceAccessModes {
+		return nil, status.Error(codes.Unimplemented, "Unimplemented ControllerUnpublishVolume")
+	}
+	logrus.Infof("ControllerUnpublishVolume: volume id: %s node id: %s", req.GetVolumeId(), req.GetNodeId())
+
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	vol, err := cs.Driver.parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	cs.attachMu.Lock()
+	defer cs.attachMu.Unlock()
+
+	recordPath, release, err := cs.attachmentPath(vol)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	record, err := readAttachments(recordPath, vol.id)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// an empty node id unpublishes the volume from every node
+	if req.GetNodeId() == "" {
+		record.Nodes = nil
+	} else {
+		delete(record.Nodes, req.GetNodeId())
+	}
+	if err := writeAttachments(recordPath, record); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// attachmentPath returns the path of the attachment record of vol, release
+// must be called once the caller is done with it. Records are kept in the
+// snapshot directory of the export of vol, which the driver owns. The export
+// of an imported volume is user data, its records go to the default share
+// or else to the first backend.
+func (cs *ControllerServer) attachmentPath(vol *nfsVolume) (string, func(), error) {
+	snap := &nfsSnapshot{
+		server:       vol.server,
+		share:        vol.exportShare(cs.Driver.nfsSnapshotPath),
+		mountOptions: vol.mountOptions,
+	}
+	if vol.static {
+		switch {
+		case cs.Driver.nfsServer != "":
+			snap = &nfsSnapshot{server: cs.Driver.nfsServer, share: filepath.Clean(cs.Driver.nfsSharePoint)}
+		case len(cs.Driver.backends) > 0:
+			be := cs.Driver.backends[0]
+			snap = &nfsSnapshot{server: be.Server, share: be.Share, mountOptions: be.MountOptions}
+		default:
+			return "", nil, status.Errorf(codes.FailedPrecondition, "imported volume %s needs a default share or a backend to record its attachments", vol.id)
+		}
+	}
+	snapPath, release, err := cs.snapshotPath(snap)
+	if err != nil {
+		return "", nil, err
+	}
+	dir, err := confinedDir(snapPath, attachmentsDir)
+	if err == nil {
+		err = os.MkdirAll(dir, 0700)
+	}
+	if err != nil {
+		release()
+		return "", nil, status.Error(codes.Internal, err.Error())
+	}
+	return filepath.Join(dir, attachmentFile(vol)), release, nil
+}
+
+// attachmentFile returns the file name of the attachment record of vol,
+// named after its id since the records of the volumes of every export may
+// share a directory.
+func attachmentFile(vol *nfsVolume) string {
+	sum := sha256.Sum256([]byte(vol.id))
+	return hex.EncodeToString(sum[:]) + ".json"
+}
+
+// readAttachments reads an attachment record, a missing record has no
+// attachments.
+func readAttachments(path, volumeID string) (*attachmentRecord, error) {
+	record := &attachmentRecord{VolumeID: volumeID}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, record); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+		}
+	}
+	if record.Nodes == nil {
+		record.Nodes = make(map[string]attachment)
+	}
+	return record, nil
+}
+
+// writeAttachments replaces an attachment record atomically, a record
+// without attachments is removed.
+func writeAttachments(path string, record *attachmentRecord) error {
+	if len(record.Nodes) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, 0600)
+}
+
+// removeAttachments removes the attachment record of a deleted volume.
+func (cs *ControllerServer) removeAttachments(vol *nfsVolume) error {
+	cs.attachMu.Lock()
+	defer cs.attachMu.Unlock()
+	path, release, err := cs.attachmentPath(vol)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
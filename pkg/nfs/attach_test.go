@@ -0,0 +1,126 @@
+package nfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+func newTestAttachController(t *testing.T) (*ControllerServer, func()) {
+	dir, err := ioutil.TempDir("", "csi-nfs-attach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &nfsDriver{
+		name:               "csi-nfs",
+		nfsServer:          "srv",
+		nfsSharePoint:      "/data",
+		nfsSnapshotPath:    "snapshots",
+		enforceAccessModes: true,
+	}
+	d.AddVolumeCapabilityAccessModes(supportedAccessModes)
+	cs := newControllerServer(d, mount.NewFakeMounter(nil), dir, 0)
+	return cs, func() {
+		cs.exports.stop()
+		os.RemoveAll(dir)
+	}
+}
+
+// createTestVolume creates the directory of vol on its export.
+func createTestVolume(t *testing.T, cs *ControllerServer, vol *nfsVolume) string {
+	volPath, release, err := cs.volumePath(vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if err := os.MkdirAll(volPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return volPath
+}
+
+func publishRequest(vol *nfsVolume, node string, mode csi.VolumeCapability_AccessMode_Mode, readonly bool) *csi.ControllerPublishVolumeRequest {
+	return &csi.ControllerPublishVolumeRequest{
+		VolumeId: vol.id,
+		NodeId:   node,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		},
+		Readonly: readonly,
+	}
+}
+
+func TestControllerPublishVolumeAccessModes(t *testing.T) {
+	cs, cleanup := newTestAttachController(t)
+	defer cleanup()
+	vol := newNFSVolume("srv", "/data", "pvc")
+	createTestVolume(t, cs, vol)
+
+	rwo := csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+	tests := []struct {
+		name      string
+		node      string
+		readonly  bool
+		unpublish bool
+		want      codes.Code
+	}{
+		{name: "first node", node: "n1", want: codes.OK},
+		{name: "same node again", node: "n1", want: codes.OK},
+		{name: "same node read-only", node: "n1", readonly: true, want: codes.AlreadyExists},
+		{name: "other node", node: "n2", want: codes.FailedPrecondition},
+		{name: "unpublish first node", node: "n1", unpublish: true, want: codes.OK},
+		{name: "other node once unpublished", node: "n2", want: codes.OK},
+	}
+	for _, tt := range tests {
+		var err error
+		if tt.unpublish {
+			_, err = cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: vol.id, NodeId: tt.node})
+		} else {
+			_, err = cs.ControllerPublishVolume(context.Background(), publishRequest(vol, tt.node, rwo, tt.readonly))
+		}
+		if status.Code(err) != tt.want {
+			t.Errorf("%s: got %v, want %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestControllerPublishVolumeStatic(t *testing.T) {
+	cs, cleanup := newTestAttachController(t)
+	defer cleanup()
+	// the export of an imported volume is user data
+	vol := newStaticNFSVolume("other", "/import", "data")
+	volPath := createTestVolume(t, cs, vol)
+	exportPath := filepath.Dir(volPath)
+
+	rwo := csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+	if _, err := cs.ControllerPublishVolume(context.Background(), publishRequest(vol, "n1", rwo, false)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.ControllerPublishVolume(context.Background(), publishRequest(vol, "n2", rwo, false)); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("publish on a second node: got %v, want %s", err, codes.FailedPrecondition)
+	}
+
+	fis, err := ioutil.ReadDir(exportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Name() != "data" {
+		t.Errorf("publish wrote into the export of an imported volume: %v", fis)
+	}
+	recordPath, release, err := cs.attachmentPath(vol)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if _, err := os.Stat(recordPath); err != nil {
+		t.Errorf("attachment record of the imported volume: %s", err)
+	}
+}
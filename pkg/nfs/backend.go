@@ -0,0 +1,165 @@
+package nfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// errNoAccessibleBackend is returned when the requisite topologies of a
+// volume rule out every backend.
+var errNoAccessibleBackend = errors.New("no backend is accessible from the requisite topologies")
+
+// backend is an nfs export volumes can be provisioned on, it is only
+// accessible from the nodes matching its topology.
+type backend struct {
+	Name         string            `json:"name"`
+	Server       string            `json:"server"`
+	Share        string            `json:"share"`
+	MountOptions string            `json:"mountOptions,omitempty"`
+	Topology     map[string]string `json:"topology,omitempty"`
+	// Retention applies to the snapshots of the backend taken without a
+	// retention policy
+	Retention *retentionPolicy `json:"retention,omitempty"`
+}
+
+// loadBackends reads the backends of a json config file, an array of
+// backend objects.
+func loadBackends(path string) ([]*backend, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	var backends []*backend
+	if err := dec.Decode(&backends); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+
+	names := make(map[string]bool, len(backends))
+	for _, be := range backends {
+		if be.Name == "" || names[be.Name] {
+			return nil, fmt.Errorf("backend name %q is empty or not unique", be.Name)
+		}
+		names[be.Name] = true
+		if err := validateServer(be.Server); err != nil {
+			return nil, fmt.Errorf("backend %s: %s", be.Name, err)
+		}
+		if err := validateShare(be.Share); err != nil {
+			return nil, fmt.Errorf("backend %s: %s", be.Name, err)
+		}
+		be.Share = filepath.Clean(be.Share)
+		if err := validateMountOptions(splitMountOptions(be.MountOptions)); err != nil {
+			return nil, fmt.Errorf("backend %s: %s", be.Name, err)
+		}
+		if be.Retention != nil {
+			if err := be.Retention.validate(); err != nil {
+				return nil, fmt.Errorf("backend %s: %s", be.Name, err)
+			}
+		}
+	}
+	return backends, nil
+}
+
+// accessibleFrom reports whether the nodes of topology can mount the
+// backend, every segment of the backend topology must match.
+func (be *backend) accessibleFrom(topology *csi.Topology) bool {
+	for k, v := range be.Topology {
+		if topology.GetSegments()[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// hasTopology reports whether a backend is restricted to a topology, volumes
+// are placed by topology only then.
+func (n *nfsDriver) hasTopology() bool {
+	for _, be := range n.backends {
+		if len(be.Topology) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// topology returns the accessible topology of the volumes of the backend,
+// nil for volumes outside of any backend.
+func (be *backend) topology() []*csi.Topology {
+	if be == nil || len(be.Topology) == 0 {
+		return nil
+	}
+	segments := make(map[string]string, len(be.Topology))
+	for k, v := range be.Topology {
+		segments[k] = v
+	}
+	return []*csi.Topology{{Segments: segments}}
+}
+
+// selectBackend picks the backend of a new volume, the one named by the
+// StorageClass or the first one accessible from the preferred topologies,
+// then from the requisite ones. Requisite topologies restrict the choice,
+// it fails when no backend is accessible from any of them. It returns nil
+// when no backends are configured.
+func (n *nfsDriver) selectBackend(name string, requirements *csi.TopologyRequirement) (*backend, error) {
+	if len(n.backends) == 0 {
+		if name != "" {
+			return nil, fmt.Errorf("backend %q does not exist, no backends are configured", name)
+		}
+		return nil, nil
+	}
+
+	requisite := func(be *backend) bool {
+		if len(requirements.GetRequisite()) == 0 {
+			return true
+		}
+		for _, t := range requirements.GetRequisite() {
+			if be.accessibleFrom(t) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if name != "" {
+		for _, be := range n.backends {
+			if be.Name == name {
+				if !requisite(be) {
+					return nil, errNoAccessibleBackend
+				}
+				return be, nil
+			}
+		}
+		return nil, fmt.Errorf("backend %q does not exist", name)
+	}
+
+	for _, t := range requirements.GetPreferred() {
+		for _, be := range n.backends {
+			if be.accessibleFrom(t) && requisite(be) {
+				return be, nil
+			}
+		}
+	}
+	for _, be := range n.backends {
+		if requisite(be) {
+			return be, nil
+		}
+	}
+	return nil, errNoAccessibleBackend
+}
+
+// backendOf returns the configured backend of the export server:share.
+func (n *nfsDriver) backendOf(server, share string) *backend {
+	for _, be := range n.backends {
+		if be.Server == server && be.Share == filepath.Clean(share) {
+			return be
+		}
+	}
+	return nil
+}
@@ -1,20 +1,18 @@
 package nfs
 
 import (
-	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"k8s.io/utils/mount"
 
 	"github.com/golang/protobuf/ptypes"
 
-	"k8s.io/utils/exec"
-
 	"github.com/sirupsen/logrus"
 
-	"github.com/pborman/uuid"
-
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
@@ -24,6 +22,25 @@ import (
 type ControllerServer struct {
 	Driver  *nfsDriver
 	mounter mount.Interface
+	exports *exportManager
+
+	// attachMu serializes the updates of attachment records
+	attachMu sync.Mutex
+	// snapMu serializes the updates of the extracted snapshots of read-only
+	// snapshot volumes
+	snapMu sync.Mutex
+
+	snapshotSharesMu sync.Mutex
+	// snapshotShares are the exports snapshots were taken on since the
+	// start, besides the configured ones
+	snapshotShares map[string]snapshotShare
+
+	// listSnapshotHandles returns the snapshot ids VolumeSnapshotContents
+	// reference, retention never deletes them
+	listSnapshotHandles func(context.Context) (map[string]bool, error)
+
+	retentionStop chan struct{}
+	retentionDone chan struct{}
 }
 
 func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
@@ -33,6 +50,9 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if reqVolName == "" {
 		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
 	}
+	if err := validateName(reqVolName); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	caps := req.GetVolumeCapabilities()
 	if caps == nil {
@@ -42,6 +62,9 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		if c.GetBlock() != nil {
 			return nil, status.Error(codes.Unimplemented, "Block Volume not supported")
 		}
+		if err := cs.Driver.validateVolumeCapability(c); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
 	}
 
 	capacity := uint64(req.GetCapacityRange().GetRequiredBytes())
@@ -49,58 +72,195 @@ func (cs *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Errorf(codes.OutOfRange, "Requested capacity %d exceeds maximum allowed %d", capacity, cs.Driver.maxStorageCapacity)
 	}
 
-	volPath := filepath.Join(cs.Driver.nfsLocalMountPoint, reqVolName)
-	_, err := os.Stat(volPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			err = os.Mkdir(volPath, 0755)
-			if err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
+	params := req.GetParameters()
+	server := cs.Driver.nfsServer
+	if params["server"] != "" {
+		server = params["server"]
+	}
+	share := cs.Driver.nfsSharePoint
+	if params["share"] != "" {
+		share = params["share"]
+	}
+	mountOptions := params["mountOptions"]
+
+	var be *backend
+	if params["server"] == "" && params["share"] == "" {
+		var err error
+		be, err = cs.Driver.selectBackend(params["backend"], req.GetAccessibilityRequirements())
+		if err == errNoAccessibleBackend {
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		}
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if be != nil {
+			logrus.Infof("CreateVolume: volume %s placed on backend %s", reqVolName, be.Name)
+			server, share = be.Server, be.Share
+			if mountOptions == "" {
+				mountOptions = be.MountOptions
 			}
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
 		}
+	} else if params["backend"] != "" {
+		return nil, status.Error(codes.InvalidArgument, "backend cannot be combined with server or share")
+	} else {
+		be = cs.Driver.backendOf(server, share)
+	}
+	if err := validateServer(server); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateShare(share); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	volContext := req.GetParameters()
-	volContext["server"] = cs.Driver.nfsServer
-	volContext["share"] = filepath.Join(cs.Driver.nfsSharePoint, reqVolName)
+	if err := validateMountOptions(splitMountOptions(params["mountOptions"])); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := validateTransport(params); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
-	if req.GetVolumeContentSource() != nil {
-		contentSource := req.GetVolumeContentSource()
-		if contentSource.GetSnapshot() != nil {
-			snapID := contentSource.GetSnapshot().GetSnapshotId()
-			snapPath := filepath.Join(cs.Driver.nfsLocalMountPoint, cs.Driver.nfsSnapshotPath)
-			_, err := os.Stat(snapPath)
-			if err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-			targetPath := filepath.Join(snapPath, snapID+".tar.gz")
-			_, err = os.Stat(targetPath)
-			if err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
-			}
-			outBs, err := exec.New().CommandContext(ctx, "tar", "-zxpf", targetPath, "-C", volPath).CombinedOutput()
-			if err != nil {
-				return nil, status.Error(codes.Internal, fmt.Sprintf("%s: %s", err.Error(), string(outBs)))
-			}
+	ownership, err := parseVolumeOwnership(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	snapshotVolume, err := isReadOnlySnapshotVolume(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var vol *nfsVolume
+	if snapshotVolume {
+		snapshotID := req.GetVolumeContentSource().GetSnapshot().GetSnapshotId()
+		if snapshotID == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "%s volumes require a snapshot data source", parameterReadOnlySnapshotVolume)
+		}
+		vol, err = cs.createSnapshotVolume(ctx, reqVolName, snapshotID, caps)
+		if err != nil {
+			return nil, err
+		}
+		// the volume lives on the export of its snapshot
+		be = cs.Driver.backendOf(vol.server, vol.exportShare(cs.Driver.nfsSnapshotPath))
+		mountOptions = strings.Join(mergeMountOptions(splitMountOptions(mountOptions), []string{"ro"}), ",")
+	} else {
+		// the controller mounts the export with the same options later on
+		vol = newNFSVolumeWithOptions(server, share, reqVolName, params["mountOptions"])
+		if err := validateID(vol.id); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "volume %s", err)
+		}
+		if err := cs.createVolumeDir(ctx, vol, ownership, req.GetVolumeContentSource()); err != nil {
+			return nil, err
+		}
+	}
+
+	volContext := make(map[string]string)
+	for k, v := range params {
+		volContext[k] = v
+	}
+	volContext["server"] = vol.server
+	volContext["share"] = filepath.Join(vol.share, vol.subDir)
+	if mountOptions != "" {
+		volContext["mountOptions"] = mountOptions
+	}
+	if cs.exports.versions.enabled() {
+		// the export the volume was created or extracted on
+		share := vol.exportShare(cs.Driver.nfsSnapshotPath)
+		if v := cs.exports.version(vol.server, share, cs.exportOptions(vol.server, share, vol.mountOptions)); v != "" {
+			volContext[volumeContextNFSVersion] = v
 		}
 	}
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      reqVolName,
-			VolumeContext: volContext,
-			CapacityBytes: int64(capacity),
+			VolumeId:           vol.id,
+			VolumeContext:      volContext,
+			CapacityBytes:      int64(capacity),
+			AccessibleTopology: be.topology(),
 		},
 	}, nil
 }
 
+// createVolumeDir creates the directory of vol owned by ownership and
+// restores the snapshot of source into it.
+func (cs *ControllerServer) createVolumeDir(ctx context.Context, vol *nfsVolume, ownership *volumeOwnership, source *csi.VolumeContentSource) error {
+	volPath, release, err := cs.volumePath(vol)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	_, err = os.Stat(volPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = os.Mkdir(volPath, 0755)
+			if err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			err = ownership.apply(volPath)
+			if err != nil {
+				_ = os.Remove(volPath)
+				if os.IsPermission(err) {
+					return status.Error(codes.PermissionDenied, err.Error())
+				}
+				return status.Error(codes.Internal, err.Error())
+			}
+		} else {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if source.GetSnapshot() != nil {
+		snap, err := cs.Driver.parseSnapshotID(source.GetSnapshot().GetSnapshotId())
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		snapPath, snapRelease, err := cs.snapshotPath(snap)
+		if err != nil {
+			return err
+		}
+		defer snapRelease()
+
+		targetPath := snapshotArchive(snapPath, snap)
+		_, err = os.Stat(targetPath)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := restoreSnapshot(ctx, snapPath, snap.name, volPath); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	return nil
+}
+
 func (cs *ControllerServer) DeleteVolume(_ context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	logrus.Infof("DeleteVolume: volume id: %s", req.VolumeId)
 
-	volPath := filepath.Join(cs.Driver.nfsLocalMountPoint, req.VolumeId)
-	_, err := os.Stat(volPath)
+	vol, err := cs.Driver.parseVolumeID(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if vol.static {
+		logrus.Infof("DeleteVolume: volume %s is pre-provisioned, keeping its data", vol)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	volPath, release, err := cs.volumePath(vol)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if vol.snapshotRef != "" {
+		// the extracted snapshot is shared with the other volumes of the
+		// snapshot
+		if err := cs.deleteSnapshotVolume(vol, volPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if err := cs.removeAttachments(vol); err != nil {
+			logrus.Warnf("DeleteVolume: failed to remove the attachment record of volume %s: %s", vol, err)
+		}
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	_, err = os.Stat(volPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return &csi.DeleteVolumeResponse{}, nil
@@ -111,20 +271,14 @@ func (cs *ControllerServer) DeleteVolume(_ context.Context, req *csi.DeleteVolum
 		err := os.RemoveAll(volPath)
 		if err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
-		} else {
-			return &csi.DeleteVolumeResponse{}, nil
 		}
+		if err := cs.removeAttachments(vol); err != nil {
+			logrus.Warnf("DeleteVolume: failed to remove the attachment record of volume %s: %s", vol, err)
+		}
+		return &csi.DeleteVolumeResponse{}, nil
 	}
 }
 
-func (cs *ControllerServer) ControllerPublishVolume(_ context.Context, _ *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "Unimplemented ControllerPublishVolume")
-}
-
-func (cs *ControllerServer) ControllerUnpublishVolume(_ context.Context, _ *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "Unimplemented ControllerUnpublishVolume")
-}
-
 func (cs *ControllerServer) ListVolumes(_ context.Context, _ *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "Unimplemented ListVolumes")
 }
@@ -134,54 +288,191 @@ func (cs *ControllerServer) GetCapacity(_ context.Context, _ *csi.GetCapacityReq
 }
 
 func (cs *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	volPath := filepath.Join(cs.Driver.nfsLocalMountPoint, req.SourceVolumeId)
-	_, err := os.Stat(volPath)
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	vol, err := cs.Driver.parseVolumeID(req.SourceVolumeId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if vol.snapshotRef != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s is a read-only view of snapshot %s", req.SourceVolumeId, vol.subDir)
+	}
+	volPath, release, err := cs.volumePath(vol)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	_, err = os.Stat(volPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	snapPath := filepath.Join(cs.Driver.nfsLocalMountPoint, cs.Driver.nfsSnapshotPath)
-	_, err = os.Stat(snapPath)
+	incremental, err := isIncremental(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	retention, err := retentionFromParameters(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// snapshots are stored on the export of their source volume, named
+	// after the request so that retries find the snapshot
+	snap := newNFSSnapshot(vol, snapshotName(req.GetName()))
+	snapPath, snapRelease, err := cs.snapshotPath(snap)
+	if err != nil {
+		return nil, err
+	}
+	defer snapRelease()
+
+	err = os.MkdirAll(snapPath, 0755)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	snapID := uuid.NewUUID().String()
-	logrus.Infof("create volume [%s] snapshot: %s", req.SourceVolumeId, snapID)
-	targetPath := filepath.Join(snapPath, snapID+".tar.gz")
+	cs.snapMu.Lock()
+	resp, err := existingSnapshot(snapPath, snap, req)
+	cs.snapMu.Unlock()
+	if resp != nil || err != nil {
+		return resp, err
+	}
+	logrus.Infof("create volume [%s] snapshot: %s", req.SourceVolumeId, snap.id)
+	targetPath := snapshotArchive(snapPath, snap)
 
-	outBs, err := exec.New().CommandContext(ctx, "tar", "-zcpf", targetPath, volPath).CombinedOutput()
+	// the manifest is taken first, what changes while archiving is
+	// archived again by the next snapshot
+	manifest, err := buildManifest(volPath)
 	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("%s: %s", err.Error(), string(outBs)))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// the metadata is written first so that the parent cannot be deleted
+	// while this snapshot is taken
+	meta := &snapshotMetadata{
+		Name:           snap.name,
+		SourceVolumeID: req.SourceVolumeId,
+		CreationTime:   time.Now(),
+		Retention:      retention,
+	}
+	var members []string
+	cs.snapMu.Lock()
+	// a retry may have started meanwhile
+	if resp, err := existingSnapshot(snapPath, snap, req); resp != nil || err != nil {
+		cs.snapMu.Unlock()
+		return resp, err
+	}
+	if incremental {
+		parent, err := latestSnapshot(snapPath, req.SourceVolumeId)
+		if err == nil && parent != nil {
+			var parentManifest snapshotManifest
+			parentManifest, err = readSnapshotManifest(snapPath, parent.Name)
+			meta.Parent = parent.Name
+			members = manifest.changedSince(parentManifest)
+		}
+		if err != nil {
+			cs.snapMu.Unlock()
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	err = writeSnapshotMetadata(snapPath, meta)
+	cs.snapMu.Unlock()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	complete := false
+	defer func() {
+		if !complete {
+			_ = os.Remove(targetPath)
+			_ = os.Remove(snapshotManifestPath(snapPath, snap.name))
+			_ = os.Remove(snapshotMetadataPath(snapPath, snap.name))
+		}
+	}()
+
+	if meta.Parent != "" {
+		// the volume directory itself is always archived
+		logrus.Infof("snapshot %s archives %d paths changed since snapshot %s", snap.name, len(members), meta.Parent)
+	}
+	if err := archiveSnapshot(ctx, volPath, targetPath, members); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := writeSnapshotManifest(snapPath, snap.name, manifest); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	stat, err := os.Stat(targetPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	meta.SizeBytes = stat.Size()
+	if err := writeSnapshotMetadata(snapPath, meta); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	complete = true
+	cs.addSnapshotShare(snap)
+	return snapshotResponse(snap, meta)
+}
 
+// existingSnapshot returns the snapshot already taken for req, nil when
+// there is none. A snapshot still being taken aborts the request, one left
+// incomplete by a crash is taken again. snapMu must be held.
+func existingSnapshot(snapPath string, snap *nfsSnapshot, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	meta, err := readSnapshotMetadata(snapPath, snap.name)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	case meta.SourceVolumeID != req.GetSourceVolumeId():
+		return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for volume %s", req.GetName(), meta.SourceVolumeID)
+	case meta.SizeBytes > 0:
+		logrus.Infof("snapshot %s of volume %s already exists: %s", req.GetName(), req.GetSourceVolumeId(), snap.id)
+		return snapshotResponse(snap, meta)
+	case !isStaleSnapshot(meta, time.Now()):
+		return nil, status.Errorf(codes.Aborted, "snapshot %s is being taken", req.GetName())
+	}
+	logrus.Warnf("taking incomplete snapshot %s of volume %s again", req.GetName(), req.GetSourceVolumeId())
+	return nil, nil
+}
+
+// snapshotResponse returns the CreateSnapshot response of the complete
+// snapshot snap.
+func snapshotResponse(snap *nfsSnapshot, meta *snapshotMetadata) (*csi.CreateSnapshotResponse, error) {
+	creationTime, err := ptypes.TimestampProto(meta.CreationTime)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 	return &csi.CreateSnapshotResponse{Snapshot: &csi.Snapshot{
-		SizeBytes:      stat.Size(),
-		SnapshotId:     snapID,
-		SourceVolumeId: req.SourceVolumeId,
-		CreationTime:   ptypes.TimestampNow(),
+		SizeBytes:      meta.SizeBytes,
+		SnapshotId:     snap.id,
+		SourceVolumeId: meta.SourceVolumeID,
+		CreationTime:   creationTime,
 		ReadyToUse:     true,
 	}}, nil
-
 }
 
 func (cs *ControllerServer) DeleteSnapshot(_ context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
 	logrus.Infof("DeleteSnapshot: snapshot id %s", req.SnapshotId)
-	snapPath := filepath.Join(cs.Driver.nfsLocalMountPoint, cs.Driver.nfsSnapshotPath)
-	_, err := os.Stat(snapPath)
+	snap, err := cs.Driver.parseSnapshotID(req.SnapshotId)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	snapPath, release, err := cs.snapshotPath(snap)
+	if err != nil {
+		return nil, err
 	}
+	defer release()
 
-	targetPath := filepath.Join(snapPath, req.SnapshotId+".tar.gz")
-	err = os.Remove(targetPath)
+	_, err = os.Stat(snapPath)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	cs.snapMu.Lock()
+	defer cs.snapMu.Unlock()
+	if err := deleteSnapshot(snapPath, snap.name); err != nil {
+		return nil, err
+	}
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
@@ -208,9 +499,18 @@ func (cs *ControllerServer) ValidateVolumeCapabilities(_ context.Context, req *c
 
 	logrus.Infof("ValidateVolumeCapabilities: volume_id: %s, volume_capabilities: %v, supported_capabilities: %v", req.VolumeId, req.VolumeCapabilities, cs.Driver.cap)
 
+	vol, err := cs.Driver.parseVolumeID(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	volPath, release, err := cs.volumePath(vol)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	// check if volume exist before trying to validate it it
-	volPath := filepath.Join(cs.Driver.nfsLocalMountPoint, req.VolumeId)
-	_, err := os.Stat(volPath)
+	_, err = os.Stat(volPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "volume %q does not exist", req.VolumeId)
@@ -219,23 +519,77 @@ func (cs *ControllerServer) ValidateVolumeCapabilities(_ context.Context, req *c
 		}
 	}
 
-	// if it's not supported, we shouldn't override it
-	var vc []*csi.VolumeCapability
-	for _, c := range cs.Driver.cap {
-		vc = append(vc, &csi.VolumeCapability{
-			AccessMode: c,
-		})
+	// only confirm what was requested, and nothing unless all of it is
+	// supported
+	for _, c := range req.VolumeCapabilities {
+		if err := cs.Driver.validateVolumeCapability(c); err != nil {
+			logrus.Infof("ValidateVolumeCapabilities: %s", err)
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+		}
 	}
 	resp := &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-			VolumeCapabilities: vc,
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
 		},
 	}
 
-	logrus.Infof("ValidateVolumeCapabilities: confirmed %v supported capabilities", resp.Confirmed)
+	logrus.Infof("ValidateVolumeCapabilities: confirmed %v", resp.Confirmed)
 	return resp, nil
 }
 
+// volumePath mounts the export of the volume if needed and returns the
+// local path of the volume directory, release must be called once the
+// caller is done with the path.
+func (cs *ControllerServer) volumePath(vol *nfsVolume) (string, func(), error) {
+	// the snapshot directory lives next to the volumes and is not one
+	if vol.subDir == strings.Split(strings.Trim(filepath.Clean(cs.Driver.nfsSnapshotPath), "/"), "/")[0] {
+		return "", nil, status.Errorf(codes.InvalidArgument, "volume name %q is reserved", vol.subDir)
+	}
+
+	options := cs.exportOptions(vol.server, vol.exportShare(cs.Driver.nfsSnapshotPath), vol.mountOptions)
+	e, err := cs.exports.acquire(vol.server, vol.share, options)
+	if err != nil {
+		return "", nil, status.Error(codes.Unavailable, err.Error())
+	}
+	p, err := confinedPath(e.path, vol.subDir)
+	if err != nil {
+		cs.exports.release(e)
+		return "", nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return p, func() { cs.exports.release(e) }, nil
+}
+
+// snapshotPath mounts the export of the snapshot if needed and returns the
+// local snapshot directory, release must be called once the caller is
+// done with the path.
+func (cs *ControllerServer) snapshotPath(snap *nfsSnapshot) (string, func(), error) {
+	e, err := cs.exports.acquire(snap.server, snap.share, cs.exportOptions(snap.server, snap.share, snap.mountOptions))
+	if err != nil {
+		return "", nil, status.Error(codes.Unavailable, err.Error())
+	}
+	p, err := confinedDir(e.path, cs.Driver.nfsSnapshotPath)
+	if err != nil {
+		cs.exports.release(e)
+		return "", nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return p, func() { cs.exports.release(e) }, nil
+}
+
+// exportOptions returns the options to mount the export server:share of a
+// volume with, the volume mountOptions or else those of its backend. Empty
+// options fall back to the controller mount options.
+func (cs *ControllerServer) exportOptions(server, share, mountOptions string) string {
+	if mountOptions != "" {
+		return mountOptions
+	}
+	if be := cs.Driver.backendOf(server, share); be != nil {
+		return be.MountOptions
+	}
+	return ""
+}
+
 // ControllerGetCapabilities implements the default GRPC callout.
 // Default supports all capabilities
 func (cs *ControllerServer) ControllerGetCapabilities(_ context.Context, _ *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
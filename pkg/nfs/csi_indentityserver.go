@@ -2,6 +2,7 @@ package nfs
 
 import (
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
@@ -10,6 +11,9 @@ import (
 
 type IdentityServer struct {
 	Driver *nfsDriver
+
+	// controller is nil when the controller server is disabled
+	controller *ControllerServer
 }
 
 func (ids *IdentityServer) GetPluginInfo(_ context.Context, _ *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
@@ -28,7 +32,13 @@ func (ids *IdentityServer) GetPluginInfo(_ context.Context, _ *csi.GetPluginInfo
 }
 
 func (ids *IdentityServer) Probe(_ context.Context, _ *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+	if ids.controller != nil {
+		if err := ids.controller.exports.health(); err != nil {
+			logrus.Errorf("Probe: %s", err)
+			return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, nil
+		}
+	}
+	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
 }
 
 func (ids *IdentityServer) GetPluginCapabilities(_ context.Context, _ *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
@@ -41,6 +51,17 @@ func (ids *IdentityServer) GetPluginCapabilities(_ context.Context, _ *csi.GetPl
 			},
 		},
 	}
+	// nodes without topology could not get any volume once advertised, it
+	// is only when a backend is restricted to a topology
+	if ids.Driver.hasTopology() {
+		caps = append(caps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+				},
+			},
+		})
+	}
 	logrus.Infof("PluginCapabilities: %s", caps)
 	return &csi.GetPluginCapabilitiesResponse{
 		Capabilities: caps,
@@ -3,24 +3,120 @@ package nfs
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/utils/mount"
 )
 
+const (
+	// nodeMountModeDirect mounts the volume export at every publish target.
+	nodeMountModeDirect = "direct"
+	// nodeMountModeStage mounts the volume export once per node at the
+	// staging path and bind mounts it into every publish target.
+	nodeMountModeStage = "stage"
+	// nodeMountModeShared mounts every export once per node and bind mounts
+	// the volume sub directories into every publish target.
+	nodeMountModeShared = "shared"
+)
+
 type NodeServer struct {
 	Driver  *nfsDriver
 	mounter mount.Interface
+	// shared is only set in the shared node mount mode
+	shared *sharedExports
+	// versions negotiates the nfs version of mounts
+	versions *versionNegotiator
+	// krb5 holds the kerberos credentials of mounts using sec=krb5*
+	krb5 *krb5Credentials
+	// tunnels encrypts the traffic of mounts when the kernel cannot
+	tunnels *tlsTunnels
+	// ops bounds mount operations and tracks the hung ones by path
+	ops *operations
 }
 
-func (ns *NodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+func (ns *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	logrus.Infof("NodePublishVolume target path: %s", req.GetTargetPath())
+	logrus.Debugf("NodePublishVolume request: %s", protosanitizer.StripSecrets(req))
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	targetPath := req.GetTargetPath()
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+	if ns.publishMode(req.GetVolumeContext()) == nodeMountModeStage && req.GetStagingTargetPath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	c := req.GetVolumeCapability()
+	if c == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	if c.GetBlock() != nil {
+		return nil, status.Error(codes.InvalidArgument, "Block Volume not supported")
+	}
+	if c.GetMount() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability access type missing in request")
+	}
+	if c.GetAccessMode() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability access mode missing in request")
+	}
+	if isReadOnlyAccessMode(c.GetAccessMode().GetMode()) {
+		// reader only volumes are enforced like read-only publishes
+		req.Readonly = true
+	}
+	if req.GetVolumeContext()["server"] == "" || req.GetVolumeContext()["share"] == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume context must contain server and share")
+	}
+	if isEphemeral(req.GetVolumeContext()) {
+		if err := validateEphemeral(req.GetVolumeId(), req.GetVolumeContext()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if isPreProvisioned(req.GetVolumeContext()) {
+		if err := ns.Driver.validatePreProvisioned(req.GetVolumeId(), req.GetVolumeContext()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	mo, err := nfsMountOptions(c, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if sec := krb5Security(mo); sec != "" && ns.publishMode(req.GetVolumeContext()) == nodeMountModeShared {
+		// exports are shared between volumes and so would be their tickets
+		return nil, status.Errorf(codes.InvalidArgument, "sec=%s is not supported in the %s node mount mode", sec, nodeMountModeShared)
+	}
+	if err := validateKrb5Secrets(mo, req.GetSecrets()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := ns.validateTransport(req.GetVolumeContext()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if group := c.GetMount().GetVolumeMountGroup(); group != "" {
+		if _, err := parseVolumeMountGroup(group); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	err = ns.ops.run(ctx, targetPath, func() error {
+		return ns.publishVolume(req, mo)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// publishVolume mounts the volume of req at its target path with the nfs
+// mount options mo, it returns gRPC status errors.
+func (ns *NodeServer) publishVolume(req *csi.NodePublishVolumeRequest, mo []string) error {
 	targetPath := req.GetTargetPath()
 	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
 	logrus.Infof("NodePublishVolume %v: %v", notMnt, err)
@@ -28,85 +124,170 @@ func (ns *NodeServer) NodePublishVolume(_ context.Context, req *csi.NodePublishV
 		if os.IsNotExist(err) {
 			logrus.Info("NodePublishVolume create target path")
 			if err := os.MkdirAll(targetPath, 0750); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
+				return status.Error(codes.Internal, err.Error())
 			}
 			notMnt = true
 		} else {
-			return nil, status.Error(codes.Internal, err.Error())
+			return status.Error(codes.Internal, err.Error())
 		}
 	}
 
 	if !notMnt {
-		return &csi.NodePublishVolumeResponse{}, nil
+		mi, err := findMount(targetPath)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if mi != nil {
+			if err := ns.checkPublishedMount(req, mi, mo); err != nil {
+				return status.Errorf(codes.AlreadyExists, "%s is already mounted with another volume or options: %s", targetPath, err)
+			}
+		}
+		return nil
 	}
 
-	mo := req.GetVolumeCapability().GetMount().GetMountFlags()
-	if req.GetReadonly() {
-		mo = append(mo, "ro")
+	switch mode := ns.publishMode(req.GetVolumeContext()); {
+	case hasScratch(req.GetVolumeContext()):
+		err = ns.publishScratch(req, mo)
+	case mode == nodeMountModeStage:
+		stagingPath := req.GetStagingTargetPath()
+		bind := []string{"bind"}
+		if req.GetReadonly() {
+			bind = append(bind, "ro")
+		}
+		err = ns.mounter.Mount(stagingPath, targetPath, "", bind)
+	case mode == nodeMountModeShared:
+		vol, verr := ns.publishedVolume(req.GetVolumeId(), req.GetVolumeContext())
+		if verr != nil {
+			return status.Error(codes.InvalidArgument, verr.Error())
+		}
+		err = ns.shared.publish(vol, mo, req.GetVolumeContext()[volumeContextNFSVersion], targetPath, req.GetReadonly())
+	default:
+		if req.GetReadonly() {
+			mo = mergeMountOptions(mo, []string{"ro"})
+		}
+		if err := ns.krb5.setup(targetPath, mo, req.GetSecrets()); err != nil {
+			return krb5StatusError(err)
+		}
+		err = ns.mountNFS(req.GetVolumeContext(), req.GetSecrets(), targetPath, mo)
+		if err != nil {
+			_ = ns.krb5.cleanup(targetPath)
+		}
 	}
-
-	s := req.GetVolumeContext()["server"]
-	ep := req.GetVolumeContext()["share"]
-	source := fmt.Sprintf("%s:%s", s, ep)
-
-	err = ns.mounter.Mount(source, targetPath, "nfs", mo)
 	if err != nil {
-		if os.IsPermission(err) {
-			return nil, status.Error(codes.PermissionDenied, err.Error())
-		}
-		if strings.Contains(err.Error(), "invalid argument") {
-			return nil, status.Error(codes.InvalidArgument, err.Error())
+		return mountStatusError(err)
+	}
+
+	if group := req.GetVolumeCapability().GetMount().GetVolumeMountGroup(); group != "" && !req.GetReadonly() {
+		// root squashing exports refuse the chown, the volume is still
+		// usable when its owner or mode already grant the pod access
+		gid, _ := parseVolumeMountGroup(group)
+		if err := applyVolumeMountGroup(targetPath, gid); err != nil {
+			logrus.Warnf("NodePublishVolume failed to apply volume mount group %s to %s, leaving its ownership unchanged: %s", group, targetPath, err)
 		}
-		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	return &csi.NodePublishVolumeResponse{}, nil
+	return nil
 }
 
-func (ns *NodeServer) NodeUnpublishVolume(_ context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+func (ns *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	logrus.Infof("NodeUnpublishVolume target path: %s", req.GetTargetPath())
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
 	targetPath := req.GetTargetPath()
-	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
-	logrus.Infof("NodeUnpublishVolume %v: %v", notMnt, err)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, status.Error(codes.NotFound, "Targetpath not found")
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
-		}
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
-	if notMnt {
-		return nil, status.Error(codes.NotFound, "Volume not mounted")
+
+	err := ns.ops.run(ctx, targetPath, func() error {
+		return ns.unpublishVolume(req.GetVolumeId(), targetPath)
+	})
+	if err != nil {
+		return nil, err
 	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
 
-	err = mount.CleanupMountPoint(req.GetTargetPath(), ns.mounter, false)
+// unpublishVolume unmounts and removes targetPath, it succeeds when the
+// target is already gone and returns gRPC status errors.
+func (ns *NodeServer) unpublishVolume(volumeID, targetPath string) error {
+	// mountinfo is used instead of a stat of the target, which would hang
+	// when the nfs server is unreachable
+	mounted, err := isMountPoint(targetPath)
+	logrus.Infof("NodeUnpublishVolume mounted %v: %v", mounted, err)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !mounted {
+		// already unpublished, only remove what a partial cleanup left
+		if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := ns.krb5.cleanup(targetPath); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := ns.unpublishScratch(volumeID); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		return nil
 	}
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	force := false
+	if err := checkMount(targetPath, mountCheckTimeout); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("NodeUnpublishVolume %s is unhealthy, forcing unmount: %s", targetPath, err)
+		force = true
+	}
+	err = ns.unmountTarget(targetPath, force)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.krb5.cleanup(targetPath); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.unpublishScratch(volumeID); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.tunnels.collect(); err != nil {
+		logrus.Errorf("NodeUnpublishVolume failed to remove unused tls tunnels: %s", err)
+	}
+	return nil
 }
 
-func (ns *NodeServer) NodeGetInfo(_ context.Context, _ *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+func (ns *NodeServer) NodeGetInfo(ctx context.Context, _ *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	nodeInfo := &csi.NodeGetInfoResponse{
 		NodeId:            ns.Driver.nodeID,
-		MaxVolumesPerNode: 65535,
+		MaxVolumesPerNode: ns.maxVolumesPerNode(),
+	}
+	segments, err := ns.topology(ctx)
+	if err != nil {
+		// the registrar retries until the node labels can be read
+		return nil, status.Errorf(codes.Unavailable, "failed to get the topology of node %s: %s", ns.Driver.nodeID, err)
+	}
+	if len(segments) > 0 {
+		nodeInfo.AccessibleTopology = &csi.Topology{Segments: segments}
 	}
 	logrus.Infof("NodeGetInfo: %s", nodeInfo)
 	return nodeInfo, nil
 }
 
 func (ns *NodeServer) NodeGetCapabilities(_ context.Context, _ *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	nodeCaps := &csi.NodeGetCapabilitiesResponse{
-		Capabilities: []*csi.NodeServiceCapability{
-			{
-				Type: &csi.NodeServiceCapability_Rpc{
-					Rpc: &csi.NodeServiceCapability_RPC{
-						Type: csi.NodeServiceCapability_RPC_UNKNOWN,
-					},
+	rpcs := []csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+	}
+	if ns.Driver.nodeMountMode == nodeMountModeStage {
+		rpcs = append(rpcs, csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME)
+	}
+
+	nodeCaps := &csi.NodeGetCapabilitiesResponse{}
+	for _, rpc := range rpcs {
+		nodeCaps.Capabilities = append(nodeCaps.Capabilities, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: rpc,
 				},
 			},
-		},
+		})
 	}
 	logrus.Infof("NodeGetCapabilities: %s", nodeCaps)
 
@@ -117,14 +298,252 @@ func (ns *NodeServer) NodeGetVolumeStats(_ context.Context, _ *csi.NodeGetVolume
 	return nil, status.Error(codes.Unimplemented, "")
 }
 
-func (ns *NodeServer) NodeUnstageVolume(_ context.Context, _ *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+func (ns *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	if ns.Driver.nodeMountMode != nodeMountModeStage {
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
+	logrus.Infof("NodeUnstageVolume staging path: %s", req.GetStagingTargetPath())
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	err := ns.ops.run(ctx, stagingPath, func() error {
+		mounted, err := isMountPoint(stagingPath)
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if !mounted {
+			if err := os.Remove(stagingPath); err != nil && !os.IsNotExist(err) {
+				return status.Error(codes.Internal, err.Error())
+			}
+		} else {
+			force := checkMount(stagingPath, mountCheckTimeout) != nil
+			if err := unmountAndRemove(ns.mounter, stagingPath, force); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+		if err := ns.krb5.cleanup(stagingPath); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := ns.tunnels.collect(); err != nil {
+			logrus.Errorf("NodeUnstageVolume failed to remove unused tls tunnels: %s", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (ns *NodeServer) NodeStageVolume(_ context.Context, _ *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+func (ns *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	if ns.Driver.nodeMountMode != nodeMountModeStage {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	logrus.Infof("NodeStageVolume staging path: %s", req.GetStagingTargetPath())
+	logrus.Debugf("NodeStageVolume request: %s", protosanitizer.StripSecrets(req))
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if stagingPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+	mo, err := nfsMountOptions(req.GetVolumeCapability(), req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if isReadOnlyAccessMode(req.GetVolumeCapability().GetAccessMode().GetMode()) {
+		mo = mergeMountOptions(mo, []string{"ro"})
+	}
+	if err := validateKrb5Secrets(mo, req.GetSecrets()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := ns.validateTransport(req.GetVolumeContext()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	err = ns.ops.run(ctx, stagingPath, func() error {
+		notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				if err := os.MkdirAll(stagingPath, 0750); err != nil {
+					return status.Error(codes.Internal, err.Error())
+				}
+				notMnt = true
+			} else {
+				return status.Error(codes.Internal, err.Error())
+			}
+		}
+		if !notMnt {
+			return nil
+		}
+
+		if err := ns.krb5.setup(stagingPath, mo, req.GetSecrets()); err != nil {
+			return krb5StatusError(err)
+		}
+		err = ns.mountNFS(req.GetVolumeContext(), req.GetSecrets(), stagingPath, mo)
+		if err != nil {
+			_ = ns.krb5.cleanup(stagingPath)
+			return mountStatusError(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
 func (ns *NodeServer) NodeExpandVolume(_ context.Context, _ *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	return nil, status.Error(codes.Unimplemented, "")
 }
+
+// nfsSource returns the nfs source of a volume from its volume context.
+func nfsSource(volContext map[string]string) string {
+	return fmt.Sprintf("%s:%s", volContext["server"], volContext["share"])
+}
+
+// mountNFS mounts the nfs export of a volume at target, negotiating the nfs
+// version starting with the one the controller used for the volume.
+func (ns *NodeServer) mountNFS(volContext, secrets map[string]string, target string, options []string) error {
+	source := nfsSource(volContext)
+	var v string
+	var err error
+	if volContext[volumeContextTransport] != "" {
+		v, err = ns.mountTLS(volContext, secrets, target, options)
+	} else {
+		v, err = ns.versions.mount(ns.mounter, volContext["server"], source, target, options, volContext[volumeContextNFSVersion])
+	}
+	if err != nil {
+		return err
+	}
+	if v != "" {
+		logrus.Infof("mounted %s at %s with nfs version %s", source, target, v)
+	}
+	return nil
+}
+
+// unmountTarget unmounts a publish target and removes it, force detaches
+// the target right away when its server does not answer.
+func (ns *NodeServer) unmountTarget(targetPath string, force bool) error {
+	if ns.Driver.nodeMountMode == nodeMountModeShared {
+		return ns.shared.unpublish(targetPath, force)
+	}
+	return unmountAndRemove(ns.mounter, targetPath, force)
+}
+
+// publishedVolume returns the export and sub directory of a volume, from its
+// id when it is self-describing and else from its volume context.
+func (ns *NodeServer) publishedVolume(volumeID string, volContext map[string]string) (*nfsVolume, error) {
+	if strings.Contains(volumeID, volumeIDSeparator) {
+		return ns.Driver.parseVolumeID(volumeID)
+	}
+
+	server, share := volContext["server"], volContext["share"]
+	if err := validateServer(server); err != nil {
+		return nil, err
+	}
+	if err := validateShare(share); err != nil {
+		return nil, err
+	}
+	share = filepath.Clean(share)
+	if err := validateName(filepath.Base(share)); err != nil {
+		return nil, fmt.Errorf("share %q has no volume directory: %s", share, err)
+	}
+	return newNFSVolume(server, filepath.Dir(share), filepath.Base(share)), nil
+}
+
+// checkPublishedMount verifies the existing mount mi at the target path of
+// req comes from the same source with compatible options.
+func (ns *NodeServer) checkPublishedMount(req *csi.NodePublishVolumeRequest, mi *mount.MountInfo, requested []string) error {
+	expected := nfsSource(req.GetVolumeContext())
+	if ns.publishMode(req.GetVolumeContext()) == nodeMountModeShared {
+		vol, err := ns.publishedVolume(req.GetVolumeId(), req.GetVolumeContext())
+		if err != nil {
+			return err
+		}
+		expected = fmt.Sprintf("%s:%s", vol.server, vol.share)
+		if mi.Root != "/" && filepath.Base(mi.Root) != vol.subDir {
+			return fmt.Errorf("mounted directory %s is not %s", mi.Root, vol.subDir)
+		}
+	}
+	if req.GetVolumeContext()[volumeContextTransport] != "" && strings.HasPrefix(mi.Source, tunnelAddr+":") {
+		// tunneled mounts connect to the local end of their tunnel
+		expected = tunnelAddr + ":" + strings.SplitN(expected, ":", 2)[1]
+	}
+	if !sameNFSSource(mi.Source, expected) {
+		return fmt.Errorf("mounted source %s is not %s", mi.Source, expected)
+	}
+
+	_, ro := mountOptionValue(requested, "ro")
+	_, mountedRO := mountOptionValue(mi.MountOptions, "ro")
+	if req.GetReadonly() || ro {
+		if !mountedRO {
+			return fmt.Errorf("mounted read-write, read-only requested")
+		}
+	} else if mountedRO {
+		return fmt.Errorf("mounted read-only, read-write requested")
+	}
+
+	for _, key := range []string{"sec", "proto", "vers", "nfsvers"} {
+		want, ok := mountOptionValue(requested, key)
+		if !ok {
+			continue
+		}
+		// the kernel always reports the version as vers
+		superKey := key
+		if key == "nfsvers" {
+			superKey = "vers"
+		}
+		got, _ := mountOptionValue(mi.SuperOptions, superKey)
+		// vers=4 lets the kernel pick the minor version
+		if got != want && !strings.HasPrefix(got, want+".") {
+			return fmt.Errorf("mounted with %s=%s, %s=%s requested", key, got, key, want)
+		}
+	}
+	for _, flags := range [][2]string{{"hard", "soft"}, {"soft", "hard"}} {
+		_, want := mountOptionValue(requested, flags[0])
+		_, other := mountOptionValue(mi.SuperOptions, flags[1])
+		if want && other {
+			return fmt.Errorf("mounted %s, %s requested", flags[1], flags[0])
+		}
+	}
+	return nil
+}
+
+// sameNFSSource compares two server:path nfs sources.
+func sameNFSSource(a, b string) bool {
+	as, bs := strings.SplitN(a, ":", 2), strings.SplitN(b, ":", 2)
+	if len(as) != 2 || len(bs) != 2 {
+		return a == b
+	}
+	return as[0] == bs[0] && filepath.Clean(as[1]) == filepath.Clean(bs[1])
+}
+
+func mountStatusError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if os.IsNotExist(err) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	if os.IsPermission(err) {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	if strings.Contains(err.Error(), "invalid argument") {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
@@ -0,0 +1,139 @@
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// volumeContextEphemeral is set by kubelet for inline volumes of pods.
+	volumeContextEphemeral = "csi.storage.k8s.io/ephemeral"
+	// volumeContextScratch asks for a scratch directory of an inline volume
+	// created in its share and deleted with the pod.
+	volumeContextScratch = "scratch"
+)
+
+// isEphemeral reports whether a volume is declared inline by a pod.
+func isEphemeral(volContext map[string]string) bool {
+	return volContext[volumeContextEphemeral] == "true"
+}
+
+// publishMode returns the node mount mode of a volume, inline volumes are
+// never staged and mount their share directly.
+func (ns *NodeServer) publishMode(volContext map[string]string) string {
+	if isEphemeral(volContext) {
+		return nodeMountModeDirect
+	}
+	return ns.Driver.nodeMountMode
+}
+
+// hasScratch reports whether an inline volume uses a scratch directory.
+func hasScratch(volContext map[string]string) bool {
+	scratch, _ := strconv.ParseBool(volContext[volumeContextScratch])
+	return isEphemeral(volContext) && scratch
+}
+
+// validateEphemeral verifies the attributes of an inline volume.
+func validateEphemeral(volumeID string, volContext map[string]string) error {
+	if err := validateServer(volContext["server"]); err != nil {
+		return err
+	}
+	if err := validateShare(volContext["share"]); err != nil {
+		return err
+	}
+	if s := volContext[volumeContextScratch]; s != "" {
+		if _, err := strconv.ParseBool(s); err != nil {
+			return fmt.Errorf("invalid %s %q", volumeContextScratch, s)
+		}
+	}
+	if hasScratch(volContext) {
+		if err := validateName(volumeID); err != nil {
+			return fmt.Errorf("volume id %q cannot name a scratch directory: %s", volumeID, err)
+		}
+	}
+	return nil
+}
+
+// scratchPath returns where the share of the inline volume volumeID is
+// mounted on the node while the pod runs.
+func (ns *NodeServer) scratchPath(volumeID string) string {
+	return filepath.Join(ns.Driver.nodeDataDir, "ephemeral", volumeID)
+}
+
+// publishScratch mounts the share of an inline volume, creates the scratch
+// directory of the volume in it and bind mounts the directory at the target
+// path, it returns gRPC status errors.
+func (ns *NodeServer) publishScratch(req *csi.NodePublishVolumeRequest, mo []string) error {
+	volumeID := req.GetVolumeId()
+	sharePath := ns.scratchPath(volumeID)
+
+	mounted, err := isMountPoint(sharePath)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if !mounted {
+		if err := os.MkdirAll(sharePath, 0750); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		if err := ns.krb5.setup(sharePath, mo, req.GetSecrets()); err != nil {
+			return krb5StatusError(err)
+		}
+		logrus.Infof("mount share of inline volume %s: %s => %s", volumeID, nfsSource(req.GetVolumeContext()), sharePath)
+		if err := ns.mountNFS(req.GetVolumeContext(), req.GetSecrets(), sharePath, mo); err != nil {
+			_ = ns.krb5.cleanup(sharePath)
+			return mountStatusError(err)
+		}
+	}
+
+	scratch := filepath.Join(sharePath, volumeID)
+	if err := os.Mkdir(scratch, 0755); err != nil && !os.IsExist(err) {
+		_ = ns.unpublishScratch(volumeID)
+		return mountStatusError(err)
+	}
+
+	bind := []string{"bind"}
+	if req.GetReadonly() {
+		bind = append(bind, "ro")
+	}
+	if err := ns.mounter.Mount(scratch, req.GetTargetPath(), "", bind); err != nil {
+		_ = ns.unpublishScratch(volumeID)
+		return mountStatusError(err)
+	}
+	return nil
+}
+
+// unpublishScratch deletes the scratch directory of the inline volume
+// volumeID and unmounts its share, it does nothing for other volumes.
+func (ns *NodeServer) unpublishScratch(volumeID string) error {
+	if validateName(volumeID) != nil {
+		return nil
+	}
+	sharePath := ns.scratchPath(volumeID)
+
+	mounted, err := isMountPoint(sharePath)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		force := false
+		if err := checkMount(sharePath, mountCheckTimeout); err != nil {
+			logrus.Warnf("share of inline volume %s is unhealthy, leaving its scratch directory: %s", volumeID, err)
+			force = true
+		} else if err := os.RemoveAll(filepath.Join(sharePath, volumeID)); err != nil {
+			return fmt.Errorf("failed to delete scratch directory of inline volume %s: %s", volumeID, err)
+		}
+		if err := unmountAndRemove(ns.mounter, sharePath, force); err != nil {
+			return err
+		}
+	} else if err := os.Remove(sharePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ns.krb5.cleanup(sharePath)
+}
@@ -0,0 +1,398 @@
+package nfs
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/utils/exec"
+	"k8s.io/utils/mount"
+)
+
+// exportMount is an nfs export mounted locally by the controller.
+type exportMount struct {
+	// mu serializes mount checks and remounts of this export
+	mu sync.Mutex
+
+	server  string
+	share   string
+	options string
+	path    string
+
+	// pinned exports are never unmounted when idle
+	pinned   bool
+	mounted  bool
+	refs     int
+	lastUsed time.Time
+}
+
+func (e *exportMount) source() string {
+	return fmt.Sprintf("%s:%s", e.server, e.share)
+}
+
+// exportManager mounts the exports used by volumes on demand, verifies
+// them before each use, remounts them when they went stale or disappeared
+// and unmounts them once they have been idle for idleTimeout.
+type exportManager struct {
+	mu          sync.Mutex
+	mounter     mount.Interface
+	dir         string
+	options     string
+	idleTimeout time.Duration
+	versions    *versionNegotiator
+	exports     map[string]*exportMount
+	stopCh      chan struct{}
+
+	// checking is set while pinned exports are checked in the background,
+	// checked once a check returned checkErr
+	checking bool
+	checked  bool
+	checkErr error
+}
+
+func newExportManager(mounter mount.Interface, dir, options string, idleTimeout time.Duration, versions *versionNegotiator) *exportManager {
+	return &exportManager{
+		mounter:     mounter,
+		dir:         dir,
+		options:     options,
+		idleTimeout: idleTimeout,
+		versions:    versions,
+		exports:     make(map[string]*exportMount),
+		stopCh:      make(chan struct{}),
+	}
+}
+
+func exportKey(server, share string) string {
+	return fmt.Sprintf("%s:%s", server, filepath.Clean(share))
+}
+
+// exportMountKey identifies a mount of an export, volumes of the same export
+// using different mount options get different mounts.
+func exportMountKey(server, share, options string) string {
+	opts := splitMountOptions(options)
+	sort.Strings(opts)
+	return exportKey(server, share) + "|" + strings.Join(opts, ",")
+}
+
+// pin registers an export which must be mounted at path, the export is
+// mounted lazily on first use and never unmounted when idle.
+func (m *exportManager) pin(server, share, options, path string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.exports[exportMountKey(server, share, options)] = &exportMount{
+		server:   server,
+		share:    filepath.Clean(share),
+		options:  options,
+		path:     path,
+		pinned:   true,
+		lastUsed: time.Now(),
+	}
+}
+
+// acquire makes sure the export is mounted with options and healthy and
+// takes a reference on it, options fall back to the controller mount
+// options when empty.
+func (m *exportManager) acquire(server, share, options string) (*exportMount, error) {
+	if options == "" {
+		options = m.options
+	}
+	m.mu.Lock()
+	key := exportMountKey(server, share, options)
+	e, ok := m.exports[key]
+	if !ok {
+		e = &exportMount{
+			server:  server,
+			share:   filepath.Clean(share),
+			options: options,
+			path:    m.exportPath(key),
+		}
+		m.exports[key] = e
+	}
+	e.refs++
+	e.lastUsed = time.Now()
+	m.mu.Unlock()
+
+	e.mu.Lock()
+	err := m.ensureMounted(e)
+	e.mu.Unlock()
+	if err != nil {
+		m.release(e)
+		return nil, err
+	}
+	return e, nil
+}
+
+// version returns the nfs version the export is mounted with using options,
+// read from the kernel options of its mount whether or not this process
+// mounted it. It is empty when the export is not mounted.
+func (m *exportManager) version(server, share, options string) string {
+	if options == "" {
+		options = m.options
+	}
+	m.mu.Lock()
+	e, ok := m.exports[exportMountKey(server, share, options)]
+	m.mu.Unlock()
+	if !ok {
+		return ""
+	}
+	mi, err := findMount(e.path)
+	if err != nil || mi == nil {
+		return ""
+	}
+	v, _ := mountOptionValue(mi.SuperOptions, "vers")
+	return v
+}
+
+// release drops a reference taken by acquire.
+func (m *exportManager) release(e *exportMount) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e.refs > 0 {
+		e.refs--
+	}
+	e.lastUsed = time.Now()
+}
+
+// check verifies the pinned exports, remounting them if needed, and
+// returns the first failure.
+func (m *exportManager) check() error {
+	m.mu.Lock()
+	var pinned []*exportMount
+	for _, e := range m.exports {
+		if e.pinned {
+			pinned = append(pinned, e)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, e := range pinned {
+		e.mu.Lock()
+		err := m.ensureMounted(e)
+		e.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// health returns the result of the last check of the pinned exports and
+// starts a new one in the background, so that a hung server never blocks
+// the caller. Exports are unhealthy until their first check returned.
+func (m *exportManager) health() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pinned := false
+	for _, e := range m.exports {
+		pinned = pinned || e.pinned
+	}
+	if !pinned {
+		return nil
+	}
+	if !m.checking {
+		m.checking = true
+		go func() {
+			err := m.check()
+			m.mu.Lock()
+			m.checking, m.checked, m.checkErr = false, true, err
+			m.mu.Unlock()
+		}()
+	}
+	if !m.checked {
+		return fmt.Errorf("nfs exports are being checked")
+	}
+	return m.checkErr
+}
+
+// exportPath returns a flat directory name for the export mount key, so
+// that exports sharing a path prefix are never mounted inside each other.
+func (m *exportManager) exportPath(key string) string {
+	sum := sha1.Sum([]byte(key))
+	server := strings.SplitN(key, ":", 2)[0]
+	return filepath.Join(m.dir, fmt.Sprintf("%s-%s", server, hex.EncodeToString(sum[:])[:12]))
+}
+
+// ensureMounted verifies the export is mounted, it is (re)mounted when the
+// mount point is missing, not mounted or stale. Callers must hold e.mu.
+func (m *exportManager) ensureMounted(e *exportMount) error {
+	notMnt, err := m.mounter.IsLikelyNotMountPoint(e.path)
+	switch {
+	case err == nil && !notMnt:
+		e.mounted = true
+		return nil
+	case err == nil || os.IsNotExist(err):
+		if e.mounted {
+			logrus.Warnf("nfs export %s disappeared from %s, remounting", e.source(), e.path)
+		}
+	case mount.IsCorruptedMnt(err):
+		logrus.Warnf("nfs export %s mounted at %s is stale, remounting: %s", e.source(), e.path, err)
+		if err := forceUnmount(m.mounter, e.path); err != nil {
+			e.mounted = false
+			return fmt.Errorf("failed to unmount stale nfs export %s: %s", e.source(), err)
+		}
+	default:
+		e.mounted = false
+		return fmt.Errorf("failed to check nfs export %s: %s", e.source(), err)
+	}
+
+	e.mounted = false
+	if err := m.mount(e); err != nil {
+		return err
+	}
+	e.mounted = true
+	return nil
+}
+
+func (m *exportManager) mount(e *exportMount) error {
+	if err := os.MkdirAll(e.path, 0755); err != nil {
+		return fmt.Errorf("failed to create export mount point %s: %s", e.path, err)
+	}
+
+	logrus.Infof("mount nfs export: %s => %s(%s)", e.source(), e.path, e.options)
+	v, err := m.versions.mount(m.mounter, e.server, e.source(), e.path, splitMountOptions(e.options), "")
+	if err != nil {
+		return fmt.Errorf("failed to mount %s: %s", e.source(), err)
+	}
+	if v != "" {
+		logrus.Infof("mounted nfs export %s with version %s", e.source(), v)
+	}
+	return nil
+}
+
+// unmountIdle unmounts every export without references which has not been
+// used for idleTimeout.
+func (m *exportManager) unmountIdle() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, e := range m.exports {
+		if e.pinned || e.refs > 0 || time.Since(e.lastUsed) < m.idleTimeout {
+			continue
+		}
+		// nobody can take e.mu without a reference, so this never blocks
+		e.mu.Lock()
+		if e.mounted {
+			logrus.Infof("unmount idle nfs export: %s => %s", e.source(), e.path)
+			if err := mount.CleanupMountPoint(e.path, m.mounter, false); err != nil {
+				logrus.Errorf("failed to unmount idle nfs export %s: %s", e.source(), err)
+				e.mu.Unlock()
+				continue
+			}
+		}
+		e.mu.Unlock()
+		delete(m.exports, key)
+	}
+}
+
+// run unmounts idle exports periodically until stop is called.
+func (m *exportManager) run() {
+	if m.idleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(m.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.unmountIdle()
+		case <-m.stopCh:
+			return
+		}
+	}
+}
+
+// stop stops unmounting idle exports and unmounts every mounted export no
+// operation uses anymore. Exports still referenced by operations which did
+// not return in time are left mounted, their lock may be held on a hung
+// server.
+func (m *exportManager) stop() {
+	close(m.stopCh)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, e := range m.exports {
+		if e.refs > 0 {
+			logrus.Warnf("nfs export %s is still in use, leaving it mounted at %s", e.source(), e.path)
+			continue
+		}
+		e.mu.Lock()
+		if e.mounted {
+			logrus.Infof("unmount nfs export: %s => %s", e.source(), e.path)
+			if err := mount.CleanupMountPoint(e.path, m.mounter, false); err != nil {
+				logrus.Errorf("failed to unmount nfs export %s: %s", e.source(), err)
+				if err := forceUnmount(m.mounter, e.path); err != nil {
+					logrus.Errorf("failed to force unmount nfs export %s: %s", e.source(), err)
+				}
+			}
+			e.mounted = false
+		}
+		e.mu.Unlock()
+		delete(m.exports, key)
+	}
+}
+
+// forceUnmount unmounts a stale mount point, falling back to a lazy forced
+// unmount when the server does not answer anymore.
+func forceUnmount(mounter mount.Interface, path string) error {
+	if err := mounter.Unmount(path); err == nil {
+		return nil
+	}
+	return lazyUnmount(path)
+}
+
+// unmountTimeout bounds a regular unmount before falling back to a lazy
+// forced one.
+const unmountTimeout = 30 * time.Second
+
+// unmountAndRemove unmounts path and removes the mount point directory, the
+// mount is detached lazily when force is set or when a regular unmount does
+// not succeed within unmountTimeout.
+func unmountAndRemove(mounter mount.Interface, path string, force bool) error {
+	if !force {
+		done := make(chan error, 1)
+		go func() {
+			done <- mounter.Unmount(path)
+		}()
+		select {
+		case err := <-done:
+			if err != nil {
+				logrus.Warnf("failed to unmount %s, forcing: %s", path, err)
+				force = true
+			}
+		case <-time.After(unmountTimeout):
+			logrus.Warnf("unmount of %s did not return within %s, forcing", path, unmountTimeout)
+			force = true
+		}
+	}
+	if force {
+		if err := lazyUnmount(path); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// lazyUnmount detaches a mount point right away without waiting for its
+// server, it is used for mounts whose server is not answering.
+func lazyUnmount(path string) error {
+	out, err := exec.New().Command("umount", "-f", "-l", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, string(out))
+	}
+	return nil
+}
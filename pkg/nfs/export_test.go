@@ -0,0 +1,96 @@
+package nfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"k8s.io/utils/mount"
+)
+
+func newTestExportManager(t *testing.T) (*exportManager, *mount.FakeMounter, func()) {
+	dir, err := ioutil.TempDir("", "csi-nfs-exports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounter := mount.NewFakeMounter(nil)
+	m := newExportManager(mounter, dir, "rw,vers=4", 0, newVersionNegotiator(nil))
+	return m, mounter, func() { os.RemoveAll(dir) }
+}
+
+func isMounted(t *testing.T, mounter mount.Interface, path string) bool {
+	notMnt, err := mounter.IsLikelyNotMountPoint(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return !notMnt
+}
+
+func TestExportManagerAcquire(t *testing.T) {
+	m, mounter, cleanup := newTestExportManager(t)
+	defer cleanup()
+
+	a, err := m.acquire("srv", "/data", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the same export and options share a mount
+	b, err := m.acquire("srv", "/data/", "vers=4,rw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a != b || a.refs != 2 {
+		t.Fatalf("acquire() returned different mounts or %d refs, want one mount with 2 refs", a.refs)
+	}
+	// other options get a mount of their own
+	c, err := m.acquire("srv", "/data", "rw,vers=4,nconnect=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == a || c.path == a.path {
+		t.Fatalf("acquire() with other options shares the mount %s", a.path)
+	}
+	if n := len(mounter.GetLog()); n != 2 {
+		t.Errorf("acquire() mounted %d times, want 2", n)
+	}
+
+	m.release(a)
+	m.release(c)
+	m.unmountIdle()
+	if !isMounted(t, mounter, a.path) {
+		t.Errorf("export %s still referenced was unmounted", a.path)
+	}
+	if isMounted(t, mounter, c.path) {
+		t.Errorf("idle export %s was not unmounted", c.path)
+	}
+
+	m.release(b)
+	m.unmountIdle()
+	if isMounted(t, mounter, a.path) {
+		t.Errorf("idle export %s was not unmounted", a.path)
+	}
+}
+
+func TestExportManagerStop(t *testing.T) {
+	m, mounter, cleanup := newTestExportManager(t)
+	defer cleanup()
+
+	idle, err := m.acquire("srv", "/idle", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.release(idle)
+	// an operation stuck on a hung server still holds its export
+	busy, err := m.acquire("srv", "/busy", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.stop()
+	if isMounted(t, mounter, idle.path) {
+		t.Errorf("idle export %s was not unmounted", idle.path)
+	}
+	if !isMounted(t, mounter, busy.path) {
+		t.Errorf("export %s in use was unmounted", busy.path)
+	}
+}
@@ -0,0 +1,395 @@
+package nfs
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/exec"
+)
+
+// Secret keys of the kerberos credentials of a volume, either a keytab and
+// the principal to get a ticket for or a ready to use credential cache. The
+// keytab and the cache are binary and so base64 encoded, csi secrets must be
+// valid utf-8.
+const (
+	krb5SecretKeytab    = "keytab"
+	krb5SecretPrincipal = "principal"
+	krb5SecretCCache    = "ccache"
+	// krb5SecretConfig optionally replaces the krb5.conf of the node
+	krb5SecretConfig = "krb5.conf"
+	// krb5SecretUID optionally sets the uid the credentials are used for,
+	// 0 by default
+	krb5SecretUID = "uid"
+	// krb5RenewInterval is how often the credential caches are refreshed.
+	krb5RenewInterval = time.Hour
+)
+
+// krb5Security returns the kerberos flavor of mount options, if any.
+func krb5Security(options []string) string {
+	sec, _ := mountOptionValue(options, "sec")
+	for _, flavor := range strings.Split(sec, ":") {
+		if strings.HasPrefix(flavor, "krb5") {
+			return sec
+		}
+	}
+	return ""
+}
+
+// validateKrb5Secrets verifies secrets hold credentials for mount options
+// using kerberos.
+func validateKrb5Secrets(options []string, secrets map[string]string) error {
+	sec := krb5Security(options)
+	if sec == "" {
+		return nil
+	}
+	if _, err := krb5UID(secrets); err != nil {
+		return err
+	}
+	for _, key := range []string{krb5SecretCCache, krb5SecretKeytab} {
+		if _, err := krb5SecretData(secrets, key); err != nil {
+			return err
+		}
+	}
+	if secrets[krb5SecretCCache] != "" {
+		return nil
+	}
+	if secrets[krb5SecretKeytab] == "" {
+		return fmt.Errorf("sec=%s requires a %s or %s secret", sec, krb5SecretKeytab, krb5SecretCCache)
+	}
+	if secrets[krb5SecretPrincipal] == "" {
+		return fmt.Errorf("sec=%s with a %s secret requires a %s secret", sec, krb5SecretKeytab, krb5SecretPrincipal)
+	}
+	return nil
+}
+
+// krb5SecretData returns the base64 decoded secret key, line breaks of the
+// encoding are ignored.
+func krb5SecretData(secrets map[string]string, key string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(secrets[key]), ""))
+	if err != nil {
+		return nil, fmt.Errorf("secret %s is not base64 encoded: %s", key, err)
+	}
+	return b, nil
+}
+
+// krb5Credentials manages the kerberos credential caches of the mounts of
+// a node under dir. rpc.gssd, run with -n -d pointing at dir, looks the
+// credentials of an nfs call up by uid in the caches named krb5cc_<uid>
+// and owned by that uid, mounts being done by root use the cache of uid 0.
+// The volumes of a uid thus share its cache and must use the same
+// principal on a node. Every mount keeps a record of the uid and principal
+// it uses next to its keytab, which renews the tickets of the cache.
+type krb5Credentials struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// krb5Record is the kerberos identity a mount uses.
+type krb5Record struct {
+	UID       int    `json:"uid"`
+	Principal string `json:"principal"`
+}
+
+// krb5ConflictError is returned when a mount would replace the credentials
+// of the mounts of the same uid with another principal.
+type krb5ConflictError struct {
+	uid                 int
+	principal, existing string
+}
+
+func (e *krb5ConflictError) Error() string {
+	return fmt.Sprintf("uid %d already uses kerberos principal %s on this node, not %s", e.uid, e.existing, e.principal)
+}
+
+// krb5StatusError converts an error of setup to a gRPC status error.
+func krb5StatusError(err error) error {
+	if _, ok := err.(*krb5ConflictError); ok {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Errorf(codes.Unauthenticated, "failed to set up kerberos credentials: %s", err)
+}
+
+func newKrb5Credentials(dir string) *krb5Credentials {
+	return &krb5Credentials{dir: dir}
+}
+
+// krb5UID returns the uid the credentials of secrets are for.
+func krb5UID(secrets map[string]string) (int, error) {
+	v := secrets[krb5SecretUID]
+	if v == "" {
+		return 0, nil
+	}
+	uid, err := strconv.Atoi(v)
+	if err != nil || uid < 0 {
+		return 0, fmt.Errorf("invalid %s secret %q", krb5SecretUID, v)
+	}
+	return uid, nil
+}
+
+// files returns the record, keytab and config paths of the mount at target.
+func (k *krb5Credentials) files(target string) (record, keytab, config string) {
+	sum := sha1.Sum([]byte(filepath.Clean(target)))
+	id := hex.EncodeToString(sum[:])[:12]
+	return filepath.Join(k.dir, id+".json"),
+		filepath.Join(k.dir, id+".keytab"),
+		filepath.Join(k.dir, id+".conf")
+}
+
+// ccache returns the credential cache rpc.gssd uses for uid.
+func (k *krb5Credentials) ccache(uid int) string {
+	return filepath.Join(k.dir, "krb5cc_"+strconv.Itoa(uid))
+}
+
+// records returns the records of every mount by record path.
+func (k *krb5Credentials) records() (map[string]*krb5Record, error) {
+	paths, err := filepath.Glob(filepath.Join(k.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]*krb5Record, len(paths))
+	for _, p := range paths {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		r := &krb5Record{}
+		if err := json.Unmarshal(b, r); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", p, err)
+		}
+		records[p] = r
+	}
+	return records, nil
+}
+
+// setup creates the credential cache for the mount at target from secrets,
+// it does nothing when options do not use kerberos.
+func (k *krb5Credentials) setup(target string, options []string, secrets map[string]string) error {
+	if krb5Security(options) == "" {
+		return nil
+	}
+	uid, err := krb5UID(secrets)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := os.MkdirAll(k.dir, 0700); err != nil {
+		return err
+	}
+
+	record, keytab, config := k.files(target)
+	// the cache is built aside, rpc.gssd must never read a partial one
+	tmp := strings.TrimSuffix(record, ".json") + ".ccache"
+	defer os.Remove(tmp)
+	done := false
+	defer func() {
+		if !done {
+			_ = os.Remove(keytab)
+			_ = os.Remove(config)
+		}
+	}()
+
+	var principal string
+	if secrets[krb5SecretCCache] != "" {
+		logrus.Infof("using kerberos credential cache from secret for %s", target)
+		c, err := krb5SecretData(secrets, krb5SecretCCache)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(tmp, c, 0600); err != nil {
+			return err
+		}
+		if principal, err = ccachePrincipal(tmp); err != nil {
+			return err
+		}
+	} else {
+		kt, err := krb5SecretData(secrets, krb5SecretKeytab)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(keytab, kt, 0600); err != nil {
+			return err
+		}
+		if c := secrets[krb5SecretConfig]; c != "" {
+			if err := writeSecretFile(config, c); err != nil {
+				return err
+			}
+		}
+		principal = secrets[krb5SecretPrincipal]
+		logrus.Infof("kinit %s for %s", principal, target)
+		if err := kinit(keytab, config, tmp, principal); err != nil {
+			return err
+		}
+	}
+
+	records, err := k.records()
+	if err != nil {
+		return err
+	}
+	for p, r := range records {
+		if p != record && r.UID == uid && r.Principal != principal {
+			return &krb5ConflictError{uid: uid, principal: principal, existing: r.Principal}
+		}
+	}
+
+	if err := os.Chown(tmp, uid, -1); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, k.ccache(uid)); err != nil {
+		return err
+	}
+	b, err := json.Marshal(&krb5Record{UID: uid, Principal: principal})
+	if err != nil {
+		return err
+	}
+	if err := writeSecretFile(record, string(b)); err != nil {
+		return err
+	}
+	done = true
+	return nil
+}
+
+// cleanup removes the credentials of the mount at target, the cache of its
+// uid goes away with the last mount using it.
+func (k *krb5Credentials) cleanup(target string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	record, keytab, config := k.files(target)
+	records, err := k.records()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, f := range []string{record, keytab, config} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	r, ok := records[record]
+	if !ok {
+		return nil
+	}
+	for p, other := range records {
+		if p != record && other.UID == r.UID {
+			return nil
+		}
+	}
+	if err := os.Remove(k.ccache(r.UID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// renew refreshes the cache of every uid in use, from the keytab of one of
+// its mounts or else by renewing its tickets.
+func (k *krb5Credentials) renew() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	records, err := k.records()
+	if err != nil {
+		logrus.Errorf("failed to list kerberos credentials: %s", err)
+		return
+	}
+	keytabs := make(map[int]string)
+	for p, r := range records {
+		keytab := strings.TrimSuffix(p, ".json") + ".keytab"
+		if _, ok := keytabs[r.UID]; !ok {
+			keytabs[r.UID] = ""
+		}
+		if _, err := os.Stat(keytab); err == nil {
+			keytabs[r.UID] = p
+		}
+	}
+
+	for uid, p := range keytabs {
+		ccache := k.ccache(uid)
+		if p == "" {
+			// caches from secrets can only be renewed up to their renewable
+			// lifetime, the secret must be updated after that
+			out, err := exec.New().Command("kinit", "-R", "-c", "FILE:"+ccache).CombinedOutput()
+			if err != nil {
+				logrus.Warnf("failed to renew the kerberos credential cache of uid %d: %s: %s", uid, err, strings.TrimSpace(string(out)))
+			}
+			continue
+		}
+
+		base := strings.TrimSuffix(p, ".json")
+		config := base + ".conf"
+		if _, err := os.Stat(config); err != nil {
+			config = ""
+		}
+		tmp := base + ".ccache"
+		err := kinit(base+".keytab", config, tmp, records[p].Principal)
+		if err == nil {
+			err = os.Chown(tmp, uid, -1)
+		}
+		if err == nil {
+			err = os.Rename(tmp, ccache)
+		}
+		if err != nil {
+			_ = os.Remove(tmp)
+			logrus.Errorf("failed to renew the kerberos credentials of uid %d: %s", uid, err)
+		}
+	}
+}
+
+// run renews the credentials every interval.
+func (k *krb5Credentials) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		k.renew()
+	}
+}
+
+// kinit gets a ticket for principal from keytab into the cache ccache, with
+// the krb5.conf config unless it is empty.
+func kinit(keytab, config, ccache, principal string) error {
+	cmd := exec.New().Command("kinit", "-k", "-t", keytab, "-c", "FILE:"+ccache, principal)
+	if config != "" {
+		cmd.SetEnv(append(os.Environ(), "KRB5_CONFIG="+config))
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("kinit %s failed: %s: %s", principal, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// ccachePrincipal returns the default principal of the cache ccache.
+func ccachePrincipal(ccache string) (string, error) {
+	out, err := exec.New().Command("klist", "-c", "FILE:"+ccache).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("invalid kerberos credential cache: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if p := strings.TrimPrefix(line, "Default principal:"); p != line {
+			return strings.TrimSpace(p), nil
+		}
+	}
+	return "", fmt.Errorf("kerberos credential cache has no default principal")
+}
+
+// writeSecretFile writes data to path readable by root only, the file is
+// replaced atomically so that rpc.gssd never reads a partial cache.
+func writeSecretFile(path, data string) error {
+	return writeFileAtomic(path, []byte(data), 0600)
+}
@@ -0,0 +1,147 @@
+package nfs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// serviceAccountDir holds the credentials of the pod service account.
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// volumeSnapshotContentsPath lists the VolumeSnapshotContents.
+	volumeSnapshotContentsPath = "/apis/snapshot.storage.k8s.io/v1beta1/volumesnapshotcontents"
+	// nodesPath lists the nodes.
+	nodesPath = "/api/v1/nodes"
+)
+
+// kubeClient reads the kubernetes api from within the cluster, with the
+// service account of the pod.
+type kubeClient struct {
+	host   string
+	client *http.Client
+}
+
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a kubernetes cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT are not set")
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificate found in %s", filepath.Join(serviceAccountDir, "ca.crt"))
+	}
+	return &kubeClient{
+		host: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{
+			Timeout: time.Minute,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+// get decodes the json object at path into v.
+func (c *kubeClient) get(ctx context.Context, path string, v interface{}) error {
+	// service account tokens are rotated, read it on every request
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodGet, c.host+path, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s: %s: %s", path, resp.Status, strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// nodeLabels returns the labels of the node name.
+func (c *kubeClient) nodeLabels(ctx context.Context, name string) (map[string]string, error) {
+	var node struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := c.get(ctx, nodesPath+"/"+url.PathEscape(name), &node); err != nil {
+		return nil, err
+	}
+	return node.Metadata.Labels, nil
+}
+
+// snapshotHandles returns the snapshot ids referenced by the
+// VolumeSnapshotContents of the driver.
+func (c *kubeClient) snapshotHandles(ctx context.Context, driver string) (map[string]bool, error) {
+	var list struct {
+		Metadata struct {
+			Continue string `json:"continue"`
+		} `json:"metadata"`
+		Items []struct {
+			Spec struct {
+				Driver string `json:"driver"`
+				Source struct {
+					SnapshotHandle string `json:"snapshotHandle"`
+				} `json:"source"`
+			} `json:"spec"`
+			Status struct {
+				SnapshotHandle string `json:"snapshotHandle"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+
+	handles := make(map[string]bool)
+	cont := ""
+	for {
+		q := url.Values{"limit": []string{"500"}}
+		if cont != "" {
+			q.Set("continue", cont)
+		}
+		list.Metadata.Continue = ""
+		list.Items = nil
+		if err := c.get(ctx, volumeSnapshotContentsPath+"?"+q.Encode(), &list); err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			if item.Spec.Driver != driver {
+				continue
+			}
+			for _, h := range []string{item.Spec.Source.SnapshotHandle, item.Status.SnapshotHandle} {
+				if h != "" {
+					handles[h] = true
+				}
+			}
+		}
+		if list.Metadata.Continue == "" {
+			return handles, nil
+		}
+		cont = list.Metadata.Continue
+	}
+}
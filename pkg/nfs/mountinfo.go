@@ -0,0 +1,50 @@
+package nfs
+
+import (
+	"path/filepath"
+	"strings"
+
+	"k8s.io/utils/mount"
+)
+
+const procMountInfo = "/proc/self/mountinfo"
+
+// findMount returns the topmost mount at path, or nil when path is not a
+// mount point. The mount point itself is never accessed, so this does not
+// hang when its server is unreachable.
+func findMount(path string) (*mount.MountInfo, error) {
+	mis, err := mount.ParseMountInfo(procMountInfo)
+	if err != nil {
+		return nil, err
+	}
+	path = filepath.Clean(path)
+	var found *mount.MountInfo
+	for i := range mis {
+		if mis[i].MountPoint == path {
+			found = &mis[i]
+		}
+	}
+	return found, nil
+}
+
+// isMountPoint tells whether path is a mount point without accessing it.
+func isMountPoint(path string) (bool, error) {
+	mi, err := findMount(path)
+	return mi != nil, err
+}
+
+// mountOptionValue returns the value of the option key in options and
+// whether it is set, flags such as "hard" have an empty value.
+func mountOptionValue(options []string, key string) (string, bool) {
+	for _, o := range options {
+		kv := strings.SplitN(o, "=", 2)
+		if kv[0] != key {
+			continue
+		}
+		if len(kv) == 2 {
+			return kv[1], true
+		}
+		return "", true
+	}
+	return "", false
+}
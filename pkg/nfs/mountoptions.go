@@ -0,0 +1,250 @@
+package nfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// mountOptionValidators lists the nfs mount options volumes may use, a nil
+// validator marks a flag which takes no value.
+var mountOptionValidators = map[string]func(string) error{
+	"vers":         oneOf("2", "3", "4", "4.0", "4.1", "4.2"),
+	"nfsvers":      oneOf("2", "3", "4", "4.0", "4.1", "4.2"),
+	"minorversion": numberIn(0, 2),
+	"proto":        oneOf("tcp", "tcp6", "udp", "udp6", "rdma", "rdma6"),
+	"nconnect":     numberIn(1, 16),
+	"rsize":        numberIn(1024, 1048576),
+	"wsize":        numberIn(1024, 1048576),
+	"timeo":        numberIn(1, 6000),
+	"retrans":      numberIn(0, 100),
+	"retry":        numberIn(0, 10000),
+	"port":         numberIn(0, 65535),
+	"sec":          listOf(":", oneOf("sys", "none", "krb5", "krb5i", "krb5p")),
+	"lookupcache":  oneOf("all", "none", "pos", "positive"),
+	"local_lock":   oneOf("none", "all", "flock", "posix"),
+	"clientaddr":   notEmpty,
+	"fsc":          notEmpty,
+	"actimeo":      numberIn(0, 1<<31-1),
+	"acregmin":     numberIn(0, 1<<31-1),
+	"acregmax":     numberIn(0, 1<<31-1),
+	"acdirmin":     numberIn(0, 1<<31-1),
+	"acdirmax":     numberIn(0, 1<<31-1),
+	"hard":         nil,
+	"soft":         nil,
+	"intr":         nil,
+	"nointr":       nil,
+	"ro":           nil,
+	"rw":           nil,
+	"sync":         nil,
+	"async":        nil,
+	"atime":        nil,
+	"noatime":      nil,
+	"relatime":     nil,
+	"nodiratime":   nil,
+	"nosuid":       nil,
+	"nodev":        nil,
+	"exec":         nil,
+	"noexec":       nil,
+	"ac":           nil,
+	"noac":         nil,
+	"cto":          nil,
+	"nocto":        nil,
+	"lock":         nil,
+	"nolock":       nil,
+	"resvport":     nil,
+	"noresvport":   nil,
+}
+
+// optionalValueMountOptions lists the options which may be given with or
+// without a value.
+var optionalValueMountOptions = map[string]bool{
+	"fsc": true,
+}
+
+// dangerousMountOptions are never used to mount volumes, they would trust
+// the setuid binaries or the device nodes of the server or change what the
+// mount does.
+var dangerousMountOptions = map[string]bool{
+	"suid":    true,
+	"dev":     true,
+	"bind":    true,
+	"rbind":   true,
+	"remount": true,
+}
+
+// exclusiveMountOptions maps the flags overriding each other to a common
+// key, the last one given wins.
+var exclusiveMountOptions = map[string]string{
+	"hard":       "hard|soft",
+	"soft":       "hard|soft",
+	"ro":         "ro|rw",
+	"rw":         "ro|rw",
+	"nfsvers":    "vers",
+	"intr":       "intr|nointr",
+	"nointr":     "intr|nointr",
+	"sync":       "sync|async",
+	"async":      "sync|async",
+	"atime":      "atime|noatime",
+	"noatime":    "atime|noatime",
+	"exec":       "exec|noexec",
+	"noexec":     "exec|noexec",
+	"ac":         "ac|noac",
+	"noac":       "ac|noac",
+	"cto":        "cto|nocto",
+	"nocto":      "cto|nocto",
+	"lock":       "lock|nolock",
+	"nolock":     "lock|nolock",
+	"resvport":   "resvport|noresvport",
+	"noresvport": "resvport|noresvport",
+}
+
+// validateMountOptions rejects unknown nfs mount options and invalid
+// values, typos would otherwise only show up as a kernel mount error. It
+// applies to the options set by the driver configuration and StorageClass
+// parameters.
+func validateMountOptions(options []string) error {
+	for _, o := range options {
+		kv := strings.SplitN(o, "=", 2)
+		if _, ok := mountOptionValidators[kv[0]]; !ok {
+			return fmt.Errorf("unsupported mount option %q", o)
+		}
+	}
+	return checkMountOptions(options)
+}
+
+// checkMountOptions rejects malformed and dangerous mount options and the
+// invalid values of known ones, other options are passed to mount as is.
+// It applies to the mount options of PersistentVolumes, which may use any
+// option of their nfs client.
+func checkMountOptions(options []string) error {
+	for _, o := range options {
+		kv := strings.SplitN(o, "=", 2)
+		if kv[0] == "" || strings.IndexFunc(o, isInvalidMountOptionRune) >= 0 {
+			return fmt.Errorf("malformed mount option %q", o)
+		}
+		if dangerousMountOptions[kv[0]] {
+			return fmt.Errorf("mount option %q is not allowed", o)
+		}
+		validate, ok := mountOptionValidators[kv[0]]
+		if !ok {
+			continue
+		}
+		if len(kv) == 1 && optionalValueMountOptions[kv[0]] {
+			continue
+		}
+		if validate == nil {
+			if len(kv) == 2 {
+				return fmt.Errorf("mount option %q takes no value", kv[0])
+			}
+			continue
+		}
+		if len(kv) != 2 {
+			return fmt.Errorf("mount option %q requires a value", kv[0])
+		}
+		if err := validate(kv[1]); err != nil {
+			return fmt.Errorf("invalid mount option %q: %s", o, err)
+		}
+	}
+	return nil
+}
+
+// mergeMountOptions returns base with every option of override appended,
+// an option of base is dropped when override sets the same option.
+func mergeMountOptions(base, override []string) []string {
+	overridden := make(map[string]bool, len(override))
+	for _, o := range override {
+		overridden[mountOptionKey(o)] = true
+	}
+
+	var merged []string
+	for _, o := range base {
+		if !overridden[mountOptionKey(o)] {
+			merged = append(merged, o)
+		}
+	}
+	return append(merged, override...)
+}
+
+func mountOptionKey(o string) string {
+	key := strings.SplitN(o, "=", 2)[0]
+	if k, ok := exclusiveMountOptions[key]; ok {
+		return k
+	}
+	return key
+}
+
+// splitMountOptions splits a comma separated list of mount options.
+func splitMountOptions(s string) []string {
+	var options []string
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			options = append(options, o)
+		}
+	}
+	return options
+}
+
+// nfsMountOptions returns the validated options used to mount the nfs
+// export of a volume. The mount flags of the capability, which come from
+// the PersistentVolume, take precedence over the mountOptions StorageClass
+// parameter carried by the volume context.
+func nfsMountOptions(c *csi.VolumeCapability, volContext map[string]string) ([]string, error) {
+	params := splitMountOptions(volContext["mountOptions"])
+	if err := validateMountOptions(params); err != nil {
+		return nil, err
+	}
+	flags := c.GetMount().GetMountFlags()
+	if err := checkMountOptions(flags); err != nil {
+		return nil, err
+	}
+	return mergeMountOptions(params, flags), nil
+}
+
+// isInvalidMountOptionRune reports whether r cannot be part of a mount
+// option, separators would smuggle in other options or id fields.
+func isInvalidMountOptionRune(r rune) bool {
+	return r <= ' ' || r == ',' || r == '#' || r == 0x7f
+}
+
+func notEmpty(v string) error {
+	if v == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	return nil
+}
+
+// listOf validates every item of a list separated by sep.
+func listOf(sep string, validate func(string) error) func(string) error {
+	return func(v string) error {
+		for _, item := range strings.Split(v, sep) {
+			if err := validate(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func oneOf(values ...string) func(string) error {
+	return func(v string) error {
+		for _, value := range values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(values, ", "))
+	}
+}
+
+func numberIn(min, max int) func(string) error {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < min || n > max {
+			return fmt.Errorf("must be a number between %d and %d", min, max)
+		}
+		return nil
+	}
+}
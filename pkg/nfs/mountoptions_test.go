@@ -0,0 +1,27 @@
+package nfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeMountOptions(t *testing.T) {
+	tests := []struct {
+		base, override, want []string
+	}{
+		{base: nil, override: nil, want: nil},
+		{base: []string{"rw", "soft"}, override: nil, want: []string{"rw", "soft"}},
+		{base: nil, override: []string{"hard"}, want: []string{"hard"}},
+		{base: []string{"rw", "soft", "timeo=10"}, override: []string{"hard"}, want: []string{"rw", "timeo=10", "hard"}},
+		{base: []string{"vers=4", "timeo=10"}, override: []string{"timeo=600"}, want: []string{"vers=4", "timeo=600"}},
+		{base: []string{"vers=4", "rw"}, override: []string{"nfsvers=3"}, want: []string{"rw", "nfsvers=3"}},
+		{base: []string{"rw", "nolock"}, override: []string{"ro", "lock"}, want: []string{"ro", "lock"}},
+		{base: []string{"noatime"}, override: []string{"atime", "noexec"}, want: []string{"atime", "noexec"}},
+	}
+	for _, tt := range tests {
+		got := mergeMountOptions(tt.base, tt.override)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mergeMountOptions(%q, %q) = %q, want %q", tt.base, tt.override, got, tt.want)
+		}
+	}
+}
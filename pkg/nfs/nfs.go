@@ -1,6 +1,11 @@
 package nfs
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
@@ -13,6 +18,8 @@ type nfsDriver struct {
 	endpoint string
 	debug    bool
 
+	shutdownTimeout time.Duration
+
 	enableIdentityServer   bool
 	enableControllerServer bool
 	enableNodeServer       bool
@@ -22,13 +29,29 @@ type nfsDriver struct {
 	nfsSharePoint        string
 	nfsLocalMountPoint   string
 	nfsLocalMountOptions string
+	nfsVersions          []string
 	nfsSnapshotPath      string
+	nfsExportMountDir    string
+	nfsExportIdleTimeout time.Duration
+	retentionInterval    time.Duration
+	backends             []*backend
+	nodeTopology         map[string]string
+	nodeTopologyLabels   []string
+
+	maxVolumesPerNode    int64
+	maxVolumesFromMounts bool
+	enforceAccessModes   bool
+
+	nodeMountMode string
+	nodeDataDir   string
+	tlsTransport  string
+	mountTimeout  time.Duration
 
 	cap   []*csi.VolumeCapability_AccessMode
 	cscap []*csi.ControllerServiceCapability
 }
 
-func NewCSIDriver(name, version, nodeID, endpoint, maxstoragecapacity, nfsServer, nfsSharePoint, nfsLocalMountPoint, nfsLocalMountOptions, nfsSnapshotPath string, enableIdentityServer, enableControllerServer, enableNodeServer, debug bool) *nfsDriver {
+func NewCSIDriver(name, version, nodeID, endpoint, maxstoragecapacity, nfsServer, nfsSharePoint, nfsLocalMountPoint, nfsLocalMountOptions, nfsVersions, nfsSnapshotPath, nfsExportMountDir, backendsConfig, nodeMountMode, nodeDataDir, tlsTransport string, nodeTopology map[string]string, nodeTopologyLabels []string, maxVolumesPerNode int64, maxVolumesFromMounts, enforceAccessModes bool, nfsExportIdleTimeout, retentionInterval, mountTimeout, shutdownTimeout time.Duration, enableIdentityServer, enableControllerServer, enableNodeServer, debug bool) *nfsDriver {
 	logrus.Infof("Driver: %s version: %s", name, version)
 
 	msc, err := bytefmt.ToBytes(maxstoragecapacity)
@@ -37,12 +60,42 @@ func NewCSIDriver(name, version, nodeID, endpoint, maxstoragecapacity, nfsServer
 		msc = 50 * bytefmt.GIGABYTE
 	}
 
+	versions, err := parseNFSVersions(nfsVersions)
+	if err != nil {
+		logrus.Fatalf("failed to parse nfs versions: %s", err)
+	}
+
+	var backends []*backend
+	if backendsConfig != "" {
+		backends, err = loadBackends(backendsConfig)
+		if err != nil {
+			logrus.Fatalf("failed to load backends: %s", err)
+		}
+		for _, be := range backends {
+			logrus.Infof("backend %s: %s:%s topology %v", be.Name, be.Server, be.Share, be.Topology)
+		}
+	}
+	if maxVolumesPerNode < 0 {
+		logrus.Fatalf("invalid max volumes per node: %d", maxVolumesPerNode)
+	}
+	for k, v := range nodeTopology {
+		if k == "" || v == "" {
+			logrus.Fatalf("invalid node topology segment %q=%q", k, v)
+		}
+	}
+	for _, k := range nodeTopologyLabels {
+		if k == "" {
+			logrus.Fatalf("invalid empty node topology label")
+		}
+	}
+
 	n := &nfsDriver{
 		name:                   name,
 		nodeID:                 nodeID,
 		version:                version,
 		endpoint:               endpoint,
 		debug:                  debug,
+		shutdownTimeout:        shutdownTimeout,
 		enableIdentityServer:   enableIdentityServer,
 		enableControllerServer: enableControllerServer,
 		enableNodeServer:       enableNodeServer,
@@ -51,17 +104,36 @@ func NewCSIDriver(name, version, nodeID, endpoint, maxstoragecapacity, nfsServer
 		nfsSharePoint:          nfsSharePoint,
 		nfsLocalMountPoint:     nfsLocalMountPoint,
 		nfsLocalMountOptions:   nfsLocalMountOptions,
+		nfsVersions:            versions,
 		nfsSnapshotPath:        nfsSnapshotPath,
+		nfsExportMountDir:      nfsExportMountDir,
+		nfsExportIdleTimeout:   nfsExportIdleTimeout,
+		retentionInterval:      retentionInterval,
+		backends:               backends,
+		nodeTopology:           nodeTopology,
+		nodeTopologyLabels:     nodeTopologyLabels,
+		maxVolumesPerNode:      maxVolumesPerNode,
+		maxVolumesFromMounts:   maxVolumesFromMounts,
+		enforceAccessModes:     enforceAccessModes,
+		nodeMountMode:          nodeMountMode,
+		nodeDataDir:            nodeDataDir,
+		tlsTransport:           tlsTransport,
+		mountTimeout:           mountTimeout,
 	}
 
-	n.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
-		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
-	})
+	n.AddVolumeCapabilityAccessModes(supportedAccessModes)
 
-	n.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+	cscap := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
-	})
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+	}
+	// publishing records the nodes of volumes to enforce single-node access
+	// modes, it requires the external-attacher
+	if enforceAccessModes {
+		cscap = append(cscap, csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME)
+	}
+	n.AddControllerServiceCapabilities(cscap)
 
 	return n
 }
@@ -71,27 +143,60 @@ func (n *nfsDriver) Run() {
 	var controllerServer csi.ControllerServer
 	var nodeServer csi.NodeServer
 
-	if n.enableIdentityServer {
-		logrus.Info("Enable gRPC Server: IdentityServer")
-		identityServer = NewIdentityServer(n)
-	}
+	var cs *ControllerServer
 	if n.enableControllerServer {
 		logrus.Info("Enable gRPC Server: ControllerServer")
-		controllerServer = NewControllerServer(n)
+		cs = NewControllerServer(n)
+		controllerServer = cs
+		go cs.runRetention(n.retentionInterval)
+	}
+	if n.enableIdentityServer {
+		logrus.Info("Enable gRPC Server: IdentityServer")
+		identityServer = NewIdentityServer(n, cs)
 	}
 	if n.enableNodeServer {
 		logrus.Info("Enable gRPC Server: NodeServer")
 		nodeServer = NewNodeServer(n)
 	}
 
-	server := NewNonBlockingGRPCServer(n.debug)
+	server := NewNonBlockingGRPCServer(n.debug, n.shutdownTimeout)
 	server.Start(
 		n.endpoint,
 		identityServer,
 		controllerServer,
 		nodeServer,
 	)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigCh
+		logrus.Infof("Received signal %s, stopping gRPC server", sig)
+		n.stop(server)
+	}()
 	server.Wait()
+
+	if cs != nil {
+		cs.stop(n.shutdownTimeout)
+	}
+	logrus.Info("Driver stopped")
+}
+
+// stop stops the gRPC server gracefully, it is forcefully stopped when
+// in-flight calls did not return within the shutdown timeout.
+func (n *nfsDriver) stop(server NonBlockingGRPCServer) {
+	stopped := make(chan struct{})
+	go func() {
+		server.Stop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(n.shutdownTimeout):
+		logrus.Warnf("gRPC server did not stop within %s, forcing stop", n.shutdownTimeout)
+		server.ForceStop()
+	}
 }
 
 func (n *nfsDriver) AddVolumeCapabilityAccessModes(vc []csi.VolumeCapability_AccessMode_Mode) {
@@ -0,0 +1,127 @@
+package nfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"k8s.io/utils/mount"
+)
+
+// mountMaxPath holds the maximum number of mounts of a mount namespace.
+const mountMaxPath = "/proc/sys/fs/mount-max"
+
+// nodeNameRegexp matches kubernetes node names, which are dns subdomains.
+var nodeNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// validateNodeID verifies the node id is a valid kubernetes node name, the
+// id of a node is published in the csinode object named after the node.
+func validateNodeID(nodeID string) error {
+	if nodeID == "" {
+		return fmt.Errorf("node id is empty")
+	}
+	if len(nodeID) > 253 || !nodeNameRegexp.MatchString(nodeID) {
+		return fmt.Errorf("node id %q is not a valid node name", nodeID)
+	}
+	return nil
+}
+
+// topology returns the topology segments of the node, the configured ones
+// and the values of the topology labels of the node object, so that a
+// single DaemonSet serves nodes of different zones.
+func (ns *NodeServer) topology(ctx context.Context) (map[string]string, error) {
+	segments := make(map[string]string, len(ns.Driver.nodeTopology)+len(ns.Driver.nodeTopologyLabels))
+	for k, v := range ns.Driver.nodeTopology {
+		segments[k] = v
+	}
+	if len(ns.Driver.nodeTopologyLabels) == 0 {
+		return segments, nil
+	}
+
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	labels, err := kube.nodeLabels(ctx, ns.Driver.nodeID)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range ns.Driver.nodeTopologyLabels {
+		// a node registered without a segment would be offered volumes of
+		// every backend
+		if labels[k] == "" {
+			return nil, fmt.Errorf("node has no %s label", k)
+		}
+		segments[k] = labels[k]
+	}
+	return segments, nil
+}
+
+// maxVolumesPerNode returns the number of volumes of this driver the node
+// accepts, the configured one capped by the mounts left on the node when
+// derived from mounts. Zero means no limit.
+func (ns *NodeServer) maxVolumesPerNode() int64 {
+	max := ns.Driver.maxVolumesPerNode
+	if !ns.Driver.maxVolumesFromMounts {
+		return max
+	}
+
+	left, err := ns.mountsLeft()
+	if err != nil {
+		logrus.Warnf("failed to derive the max volumes per node from mounts: %s", err)
+		return max
+	}
+	if max == 0 || left < max {
+		return left
+	}
+	return max
+}
+
+// mountsLeft returns the number of volumes the kernel mount limit leaves
+// room for, counting every mount which does not belong to the volumes of
+// this driver, those of other drivers and of secrets or configmaps
+// included. It is at least 1.
+func (ns *NodeServer) mountsLeft() (int64, error) {
+	b, err := ioutil.ReadFile(mountMaxPath)
+	if err != nil {
+		return 0, err
+	}
+	mountMax, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse %s: %s", mountMaxPath, err)
+	}
+
+	mis, err := mount.ParseMountInfo(procMountInfo)
+	if err != nil {
+		return 0, err
+	}
+	own, err := driverMountPoints(ns.Driver.name)
+	if err != nil {
+		return 0, err
+	}
+	var other int64
+	for _, mi := range mis {
+		if !own[mi.MountPoint] && !mount.PathWithinBase(mi.MountPoint, filepath.Clean(ns.Driver.nodeDataDir)) {
+			other++
+		}
+	}
+
+	// staged volumes take a staging mount and a bind mount per pod
+	perVolume := int64(1)
+	if ns.Driver.nodeMountMode == nodeMountModeStage {
+		perVolume = 2
+	}
+	left := (mountMax - other) / perVolume
+	if left < 1 {
+		// zero would mean no limit, a saturated node still takes as few
+		// volumes as can be reported
+		logrus.Warnf("%d mounts leave no room for volumes within the limit of %d", other, mountMax)
+		return 1, nil
+	}
+	return left, nil
+}
@@ -0,0 +1,62 @@
+package nfs
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// operations runs mount related calls under the request context bounded by
+// timeout. A call which did not return in time keeps running in the
+// background and its key stays busy until it does, so that a hung call is
+// never issued again concurrently.
+type operations struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	busy    map[string]bool
+}
+
+func newOperations(timeout time.Duration) *operations {
+	return &operations{
+		timeout: timeout,
+		busy:    make(map[string]bool),
+	}
+}
+
+// run calls fn unless a call for key is still in progress, in which case it
+// fails with Aborted. It fails with DeadlineExceeded when fn does not
+// return before the deadline of ctx or the operation timeout.
+func (o *operations) run(ctx context.Context, key string, fn func() error) error {
+	o.mu.Lock()
+	if o.busy[key] {
+		o.mu.Unlock()
+		return status.Errorf(codes.Aborted, "an operation on %s is already in progress", key)
+	}
+	o.busy[key] = true
+	o.mu.Unlock()
+
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := fn()
+		o.mu.Lock()
+		delete(o.busy, key)
+		o.mu.Unlock()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return status.Errorf(codes.DeadlineExceeded, "operation on %s did not complete: %s", key, ctx.Err())
+	}
+}
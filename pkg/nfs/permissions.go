@@ -0,0 +1,120 @@
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// volumeOwnership is the owner and mode applied to a volume directory
+// when it is created, a negative uid or gid leaves it unchanged.
+type volumeOwnership struct {
+	uid  int
+	gid  int
+	mode os.FileMode
+}
+
+// parseVolumeOwnership reads the uid, gid, mode and setgid StorageClass
+// parameters. mode is an octal string such as "0775" or "2775", setgid
+// set to "true" adds the setgid bit to it so that files created in the
+// volume inherit its group.
+func parseVolumeOwnership(params map[string]string) (*volumeOwnership, error) {
+	o := &volumeOwnership{uid: -1, gid: -1, mode: 0755}
+
+	if s := params["uid"]; s != "" {
+		uid, err := strconv.Atoi(s)
+		if err != nil || uid < 0 {
+			return nil, fmt.Errorf("invalid uid parameter %q", s)
+		}
+		o.uid = uid
+	}
+	if s := params["gid"]; s != "" {
+		gid, err := strconv.Atoi(s)
+		if err != nil || gid < 0 {
+			return nil, fmt.Errorf("invalid gid parameter %q", s)
+		}
+		o.gid = gid
+	}
+	if s := params["mode"]; s != "" {
+		mode, err := parseFileMode(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode parameter %q: %s", s, err)
+		}
+		o.mode = mode
+	}
+	if s := params["setgid"]; s != "" {
+		setgid, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid setgid parameter %q", s)
+		}
+		if setgid {
+			o.mode |= os.ModeSetgid
+		}
+	}
+	return o, nil
+}
+
+// apply sets the owner and then the mode of path, in this order because
+// chown clears the setgid bit.
+func (o *volumeOwnership) apply(path string) error {
+	if o.uid >= 0 || o.gid >= 0 {
+		if err := os.Chown(path, o.uid, o.gid); err != nil {
+			return err
+		}
+	}
+	return os.Chmod(path, o.mode)
+}
+
+// parseFileMode converts an octal unix mode, including the setuid, setgid
+// and sticky bits, to an os.FileMode.
+func parseFileMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if m > 07777 {
+		return 0, fmt.Errorf("mode out of range")
+	}
+
+	mode := os.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+// parseVolumeMountGroup returns the gid of a volume mount group.
+func parseVolumeMountGroup(group string) (int, error) {
+	gid, err := strconv.Atoi(group)
+	if err != nil || gid < 0 {
+		return 0, fmt.Errorf("invalid volume mount group %q", group)
+	}
+	return gid, nil
+}
+
+// applyVolumeMountGroup gives the group gid read, write and search access
+// to the root of a mounted volume and sets its setgid bit, so that files
+// created by the pod belong to its fsGroup. Only the volume root is
+// changed, walking a whole nfs tree would be far too slow.
+func applyVolumeMountGroup(path string, gid int) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	mode := info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSticky) | 0070 | os.ModeSetgid
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Gid) == gid && info.Mode() == mode|os.ModeDir {
+		return nil
+	}
+
+	if err := os.Chown(path, -1, gid); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
@@ -0,0 +1,301 @@
+package nfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"k8s.io/utils/mount"
+)
+
+const (
+	kubeletPodsDir = "/var/lib/kubelet/pods"
+	// kubeletCSIDir holds the staging paths of csi volumes, in pv/<name>
+	// before kubernetes 1.24 and in <driver>/<hash> since.
+	kubeletCSIDir = "/var/lib/kubelet/plugins/kubernetes.io/csi"
+	// mountCheckTimeout bounds the stat of a mount point, a mount whose
+	// server does not answer within it is considered hung.
+	mountCheckTimeout = 10 * time.Second
+)
+
+// remountOptions are the nfs options kept from the kernel options of a
+// mount when it has to be remounted.
+var remountOptions = map[string]bool{
+	"vers":    true,
+	"proto":   true,
+	"port":    true,
+	"rsize":   true,
+	"wsize":   true,
+	"timeo":   true,
+	"retrans": true,
+	"sec":     true,
+	"xprtsec": true,
+	"hard":    true,
+	"soft":    true,
+}
+
+// volData is the part of the vol_data.json file kubelet writes next to
+// the publish target of every csi volume which is used here.
+type volData struct {
+	DriverName   string `json:"driverName"`
+	VolumeHandle string `json:"volumeHandle"`
+}
+
+// reconcile checks the mounts published by this driver for the pods of
+// this node, and the staging mounts they are bound from in stage mode. It
+// remounts stale or hung mounts and reports missing ones.
+func (ns *NodeServer) reconcile() {
+	mis, err := mount.ParseMountInfo(procMountInfo)
+	if err != nil {
+		logrus.Errorf("reconcile: failed to read mounts: %s", err)
+		return
+	}
+	mounts := make(map[string]mount.MountInfo, len(mis))
+	for _, mi := range mis {
+		mounts[mi.MountPoint] = mi
+	}
+
+	var checked, remounted int
+	// staging paths by the device and root of their mount, the publish
+	// targets bound from them share both
+	staged := make(map[string]string)
+	if ns.Driver.nodeMountMode == nodeMountModeStage {
+		var files []string
+		for _, pattern := range []string{
+			filepath.Join(kubeletCSIDir, "pv", "*", "vol_data.json"),
+			filepath.Join(kubeletCSIDir, ns.Driver.name, "*", "vol_data.json"),
+		} {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				logrus.Errorf("reconcile: failed to list staged volumes: %s", err)
+				return
+			}
+			files = append(files, matches...)
+		}
+		for _, f := range files {
+			data, err := readVolData(f)
+			if err != nil {
+				logrus.Warnf("reconcile: %s", err)
+				continue
+			}
+			if data.DriverName != ns.Driver.name {
+				continue
+			}
+
+			checked++
+			stagingPath := filepath.Join(filepath.Dir(f), "globalmount")
+			mi, ok := mounts[stagingPath]
+			if !ok {
+				logrus.Warnf("reconcile: volume %s is not staged at %s", data.VolumeHandle, stagingPath)
+				continue
+			}
+			staged[mountID(mi)] = stagingPath
+			if ns.reconcileMount(data.VolumeHandle, stagingPath, "") {
+				remounted++
+			}
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(kubeletPodsDir, "*", "volumes", "kubernetes.io~csi", "*", "vol_data.json"))
+	if err != nil {
+		logrus.Errorf("reconcile: failed to list pod volumes: %s", err)
+		return
+	}
+	for _, f := range files {
+		data, err := readVolData(f)
+		if err != nil {
+			logrus.Warnf("reconcile: %s", err)
+			continue
+		}
+		if data.DriverName != ns.Driver.name {
+			continue
+		}
+
+		checked++
+		target := filepath.Join(filepath.Dir(f), "mount")
+		mi, ok := mounts[target]
+		if !ok {
+			logrus.Warnf("reconcile: volume %s is not mounted at %s", data.VolumeHandle, target)
+			continue
+		}
+		if ns.reconcileMount(data.VolumeHandle, target, staged[mountID(mi)]) {
+			remounted++
+		}
+	}
+	logrus.Infof("reconcile: checked %d volumes, remounted %d", checked, remounted)
+}
+
+// mountID identifies the mounted filesystem tree of mi, bind mounts share
+// it with their source.
+func mountID(mi mount.MountInfo) string {
+	return fmt.Sprintf("%d:%d:%s", mi.Major, mi.Minor, mi.Root)
+}
+
+// reconcileMount remounts the volume mounted at target when it is
+// unhealthy, binding it from stagingPath when it is not empty. It runs as
+// an operation on target so that it never races with a publish or an
+// unpublish, and reports whether target was remounted.
+func (ns *NodeServer) reconcileMount(volumeID, target, stagingPath string) bool {
+	remounted := false
+	err := ns.ops.run(context.Background(), target, func() error {
+		// the volume may have been unpublished meanwhile
+		mi, err := findMount(target)
+		if err != nil || mi == nil {
+			return err
+		}
+		err = checkMount(target, mountCheckTimeout)
+		if err == nil {
+			return nil
+		}
+		logrus.Warnf("reconcile: volume %s mounted at %s is unhealthy, remounting: %s", volumeID, target, err)
+		if err := ns.remount(volumeID, target, *mi, stagingPath); err != nil {
+			return err
+		}
+		remounted = true
+		return nil
+	})
+	if err != nil {
+		logrus.Errorf("reconcile: failed to remount volume %s at %s: %s", volumeID, target, err)
+	}
+	return remounted
+}
+
+// remount replaces the unhealthy mount mi of a volume at target by a new
+// one with the same nfs options, or by a bind mount of the staging path
+// stagingPath when it is not empty.
+func (ns *NodeServer) remount(volumeID, target string, mi mount.MountInfo, stagingPath string) error {
+	readonly := false
+	for _, o := range mi.MountOptions {
+		if o == "ro" {
+			readonly = true
+		}
+	}
+	if stagingPath != "" {
+		if err := lazyUnmount(target); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(target, 0750); err != nil {
+			return err
+		}
+		bind := []string{"bind"}
+		if readonly {
+			bind = append(bind, "ro")
+		}
+		return ns.mounter.Mount(stagingPath, target, "", bind)
+	}
+
+	var vol *nfsVolume
+	var err error
+	switch {
+	case strings.Contains(volumeID, volumeIDSeparator):
+		vol, err = ns.Driver.parseVolumeID(volumeID)
+		if err != nil {
+			return err
+		}
+	case ns.Driver.nodeMountMode != nodeMountModeShared && mi.Root == "/":
+		// legacy volumes are mounted from their own directory
+		parts := strings.SplitN(mi.Source, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("unexpected nfs source %q", mi.Source)
+		}
+		share := filepath.Clean(parts[1])
+		vol = newNFSVolume(parts[0], filepath.Dir(share), filepath.Base(share))
+	default:
+		return fmt.Errorf("cannot find the nfs source of legacy volume %s", volumeID)
+	}
+
+	var options []string
+	for _, o := range mi.SuperOptions {
+		if remountOptions[strings.SplitN(o, "=", 2)[0]] {
+			options = append(options, o)
+		}
+	}
+
+	if ns.Driver.nodeMountMode == nodeMountModeShared {
+		if err := ns.shared.unpublish(target, true); err != nil {
+			return err
+		}
+	} else if err := lazyUnmount(target); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(target, 0750); err != nil {
+		return err
+	}
+
+	if ns.Driver.nodeMountMode == nodeMountModeShared {
+		return ns.shared.publish(vol, options, "", target, readonly)
+	}
+	if readonly {
+		options = append(options, "ro")
+	}
+	source := vol.source()
+	if strings.HasPrefix(mi.Source, tunnelAddr+":") {
+		// the port kept from the mount options is the one of the tunnel
+		source = tunnelAddr + ":" + strings.SplitN(source, ":", 2)[1]
+	}
+	return ns.mounter.Mount(source, target, "nfs", options)
+}
+
+// driverMountPoints returns the publish targets and staging paths kubelet
+// created for the volumes of driver, which it records in the vol_data.json
+// next to them.
+func driverMountPoints(driver string) (map[string]bool, error) {
+	dirs := map[string]string{
+		filepath.Join(kubeletPodsDir, "*", "volumes", "kubernetes.io~csi", "*", "vol_data.json"): "mount",
+		filepath.Join(kubeletCSIDir, "pv", "*", "vol_data.json"):                                 "globalmount",
+		filepath.Join(kubeletCSIDir, driver, "*", "vol_data.json"):                               "globalmount",
+	}
+	points := make(map[string]bool)
+	for pattern, dir := range dirs {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			data, err := readVolData(f)
+			if err != nil {
+				logrus.Warnf("%s", err)
+				continue
+			}
+			if data.DriverName == driver {
+				points[filepath.Join(filepath.Dir(f), dir)] = true
+			}
+		}
+	}
+	return points, nil
+}
+
+func readVolData(path string) (*volData, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data := &volData{}
+	if err := json.Unmarshal(b, data); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	return data, nil
+}
+
+// checkMount stats path, it fails when the mount is stale or when the
+// server did not answer within timeout.
+func checkMount(path string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := os.Stat(path)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("stat %s did not return within %s", path, timeout)
+	}
+}
@@ -0,0 +1,394 @@
+package nfs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+// VolumeSnapshotClass parameters of the retention policy of snapshots.
+const (
+	parameterRetentionKeepLast = "retentionKeepLast"
+	parameterRetentionMaxAge   = "retentionMaxAge"
+	parameterRetentionMaxBytes = "retentionMaxBytes"
+)
+
+// retentionPolicy bounds the snapshots kept per volume, unset fields do not
+// bound anything. The most recent snapshot of a volume is always kept.
+type retentionPolicy struct {
+	// KeepLast is the number of most recent snapshots kept
+	KeepLast int `json:"keepLast,omitempty"`
+	// MaxAge expires the snapshots older than it, e.g. 720h
+	MaxAge string `json:"maxAge,omitempty"`
+	// MaxBytes expires the oldest snapshots once the total size of the
+	// snapshots of the volume exceeds it, e.g. 100G
+	MaxBytes string `json:"maxBytes,omitempty"`
+}
+
+// retentionFromParameters returns the retention policy of VolumeSnapshotClass
+// parameters, nil when they set none.
+func retentionFromParameters(params map[string]string) (*retentionPolicy, error) {
+	p := &retentionPolicy{
+		MaxAge:   params[parameterRetentionMaxAge],
+		MaxBytes: params[parameterRetentionMaxBytes],
+	}
+	if v := params[parameterRetentionKeepLast]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", parameterRetentionKeepLast, v)
+		}
+		p.KeepLast = n
+	}
+	if *p == (retentionPolicy{}) {
+		return nil, nil
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *retentionPolicy) validate() error {
+	if p.KeepLast < 0 {
+		return fmt.Errorf("invalid retention keepLast %d", p.KeepLast)
+	}
+	if p.MaxAge != "" {
+		if d, err := time.ParseDuration(p.MaxAge); err != nil || d <= 0 {
+			return fmt.Errorf("invalid retention maxAge %q", p.MaxAge)
+		}
+	}
+	if p.MaxBytes != "" {
+		if _, err := bytefmt.ToBytes(p.MaxBytes); err != nil {
+			return fmt.Errorf("invalid retention maxBytes %q: %s", p.MaxBytes, err)
+		}
+	}
+	return nil
+}
+
+// expired returns why the snapshots of a volume, sorted from the most recent
+// one, expire at now. Snapshots which do not expire are not in the map.
+func (p *retentionPolicy) expired(snapshots []*snapshotMetadata, now time.Time) map[string]string {
+	var maxAge time.Duration
+	if p.MaxAge != "" {
+		maxAge, _ = time.ParseDuration(p.MaxAge)
+	}
+	var maxBytes uint64
+	if p.MaxBytes != "" {
+		maxBytes, _ = bytefmt.ToBytes(p.MaxBytes)
+	}
+
+	expired := make(map[string]string)
+	var total uint64
+	for i, m := range snapshots {
+		total += uint64(m.SizeBytes)
+		if i == 0 {
+			continue
+		}
+		switch {
+		case p.KeepLast > 0 && i >= p.KeepLast:
+			expired[m.Name] = fmt.Sprintf("beyond the last %d", p.KeepLast)
+		case maxAge > 0 && now.Sub(m.CreationTime) > maxAge:
+			expired[m.Name] = fmt.Sprintf("older than %s", p.MaxAge)
+		case maxBytes > 0 && total > maxBytes:
+			expired[m.Name] = fmt.Sprintf("beyond %s", p.MaxBytes)
+		}
+	}
+	return expired
+}
+
+// snapshotShare is an export snapshots are stored on, policy applies to the
+// snapshots which were taken without a policy of their own.
+type snapshotShare struct {
+	server       string
+	share        string
+	mountOptions string
+	policy       *retentionPolicy
+}
+
+// retentionAction is the outcome of an expired snapshot.
+type retentionAction struct {
+	name         string
+	snapshotID   string
+	volumeID     string
+	creationTime time.Time
+	sizeBytes    int64
+	reason       string
+	// result is what was done, or would be done in a dry run
+	result string
+}
+
+// addSnapshotShare records the export snap was taken on, retention policies
+// are enforced on the configured exports and on these.
+func (cs *ControllerServer) addSnapshotShare(snap *nfsSnapshot) {
+	cs.snapshotSharesMu.Lock()
+	defer cs.snapshotSharesMu.Unlock()
+	if cs.snapshotShares == nil {
+		cs.snapshotShares = make(map[string]snapshotShare)
+	}
+	key := exportKey(snap.server, snap.share)
+	if _, ok := cs.snapshotShares[key]; !ok {
+		cs.snapshotShares[key] = snapshotShare{server: snap.server, share: snap.share, mountOptions: snap.mountOptions}
+	}
+}
+
+// retentionShares returns the exports retention policies are enforced on,
+// the configured ones and those of the snapshot ids handles, so that the
+// exports snapshots were taken on survive controller restarts.
+func (cs *ControllerServer) retentionShares(handles map[string]bool) []snapshotShare {
+	for h := range handles {
+		// legacy ids resolve to the default share, which is listed anyway
+		if snap, err := cs.Driver.parseSnapshotID(h); err == nil && strings.Contains(h, volumeIDSeparator) {
+			cs.addSnapshotShare(snap)
+		}
+	}
+
+	shares := make(map[string]snapshotShare)
+	cs.snapshotSharesMu.Lock()
+	for k, s := range cs.snapshotShares {
+		shares[k] = s
+	}
+	cs.snapshotSharesMu.Unlock()
+	if cs.Driver.nfsServer != "" {
+		share := filepath.Clean(cs.Driver.nfsSharePoint)
+		shares[exportKey(cs.Driver.nfsServer, share)] = snapshotShare{server: cs.Driver.nfsServer, share: share}
+	}
+	for _, be := range cs.Driver.backends {
+		shares[exportKey(be.Server, be.Share)] = snapshotShare{server: be.Server, share: be.Share, policy: be.Retention}
+	}
+
+	keys := make([]string, 0, len(shares))
+	for k := range shares {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var list []snapshotShare
+	for _, k := range keys {
+		list = append(list, shares[k])
+	}
+	return list
+}
+
+// snapshotKey identifies the snapshot name stored on server:share whatever
+// the mount options in its id.
+func snapshotKey(server, share, name string) string {
+	return exportKey(server, share) + volumeIDSeparator + name
+}
+
+// referencedSnapshots returns the keys of the snapshots of the snapshot ids
+// handles, legacy ids resolve to the default share.
+func (cs *ControllerServer) referencedSnapshots(handles map[string]bool) map[string]bool {
+	referenced := make(map[string]bool, len(handles))
+	for h := range handles {
+		snap, err := cs.Driver.parseSnapshotID(h)
+		if err != nil {
+			logrus.Warnf("retention: ignoring VolumeSnapshotContent handle %q: %s", h, err)
+			continue
+		}
+		referenced[snapshotKey(snap.server, snap.share, snap.name)] = true
+	}
+	return referenced
+}
+
+// inClusterSnapshotHandles returns the snapshot ids referenced by the
+// VolumeSnapshotContents of driver.
+func inClusterSnapshotHandles(driver string) func(context.Context) (map[string]bool, error) {
+	return func(ctx context.Context) (map[string]bool, error) {
+		kube, err := newInClusterKubeClient()
+		if err != nil {
+			return nil, err
+		}
+		return kube.snapshotHandles(ctx, driver)
+	}
+}
+
+// enforceRetention deletes the expired snapshots of every export which no
+// VolumeSnapshotContent references, it only reports them in a dry run. An
+// export which fails does not stop the others.
+func (cs *ControllerServer) enforceRetention(ctx context.Context, dryRun bool) ([]retentionAction, error) {
+	var actions []retentionAction
+	var errs []string
+	handles, handlesErr := cs.listSnapshotHandles(ctx)
+	if handlesErr != nil {
+		logrus.Warnf("retention: failed to list VolumeSnapshotContents, only the known exports are checked: %s", handlesErr)
+	}
+	referenced := cs.referencedSnapshots(handles)
+	for _, sh := range cs.retentionShares(handles) {
+		snapPath, release, err := cs.snapshotPath(&nfsSnapshot{server: sh.server, share: sh.share, mountOptions: sh.mountOptions})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%s: %s", sh.server, sh.share, status.Convert(err).Message()))
+			continue
+		}
+		expired, err := expiredSnapshots(snapPath, sh)
+		if err != nil {
+			release()
+			errs = append(errs, fmt.Sprintf("%s:%s: %s", sh.server, sh.share, err))
+			continue
+		}
+		if len(expired) > 0 && handlesErr != nil {
+			// never delete anything without knowing what is in use
+			release()
+			return actions, fmt.Errorf("failed to list VolumeSnapshotContents: %s", handlesErr)
+		}
+
+		for _, a := range expired {
+			switch {
+			case referenced[snapshotKey(sh.server, sh.share, a.name)]:
+				a.result = "kept, referenced by a VolumeSnapshotContent"
+			case dryRun:
+				a.result = "would delete"
+			default:
+				cs.snapMu.Lock()
+				err := deleteSnapshot(snapPath, a.name)
+				cs.snapMu.Unlock()
+				switch {
+				case status.Code(err) == codes.FailedPrecondition:
+					a.result = "kept, " + status.Convert(err).Message()
+				case err != nil:
+					a.result = "failed, " + status.Convert(err).Message()
+				default:
+					a.result = "deleted"
+				}
+			}
+			actions = append(actions, a)
+		}
+		release()
+	}
+	if len(errs) > 0 {
+		return actions, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return actions, nil
+}
+
+// expiredSnapshots returns the expired snapshots of the snapshot directory
+// snapPath of sh, from the most recent ones so that incremental snapshots
+// go before their parent.
+func expiredSnapshots(snapPath string, sh snapshotShare) ([]retentionAction, error) {
+	snapshots, err := listSnapshotMetadata(snapPath)
+	if err != nil {
+		return nil, err
+	}
+	volumes := make(map[string][]*snapshotMetadata)
+	for _, m := range snapshots {
+		// snapshots being taken have no size yet
+		if m.SizeBytes > 0 {
+			volumes[m.SourceVolumeID] = append(volumes[m.SourceVolumeID], m)
+		}
+	}
+
+	now := time.Now()
+	var expired []retentionAction
+	for volumeID, snapshots := range volumes {
+		sort.Slice(snapshots, func(i, j int) bool {
+			return snapshots[i].CreationTime.After(snapshots[j].CreationTime)
+		})
+		// the policy of the most recent snapshot applies to the volume
+		policy := snapshots[0].Retention
+		if policy == nil {
+			policy = sh.policy
+		}
+		if policy == nil {
+			continue
+		}
+		reasons := policy.expired(snapshots, now)
+		for _, m := range snapshots {
+			if reason, ok := reasons[m.Name]; ok {
+				expired = append(expired, retentionAction{
+					name:         m.Name,
+					snapshotID:   encodeID(sh.server, sh.share, m.Name, mountOptionsField(sh.mountOptions)...),
+					volumeID:     volumeID,
+					creationTime: m.CreationTime,
+					sizeBytes:    m.SizeBytes,
+					reason:       reason,
+				})
+			}
+		}
+	}
+	sort.SliceStable(expired, func(i, j int) bool {
+		return expired[i].creationTime.After(expired[j].creationTime)
+	})
+	return expired, nil
+}
+
+// runRetention enforces retention policies every interval until stop is
+// called.
+func (cs *ControllerServer) runRetention(interval time.Duration) {
+	defer close(cs.retentionDone)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			actions, err := cs.enforceRetention(context.Background(), false)
+			for _, a := range actions {
+				logrus.Infof("retention: snapshot %s of volume %s %s: %s", a.snapshotID, a.volumeID, a.reason, a.result)
+			}
+			if err != nil {
+				logrus.Errorf("retention: %s", err)
+			}
+		case <-cs.retentionStop:
+			return
+		}
+	}
+}
+
+// RetentionReport writes the snapshots expired by the retention policies to
+// w without deleting any, deletions are left to the controller which holds
+// snapMu while taking incremental snapshots. Exports are mounted in a
+// private directory so that a running driver is not disturbed.
+func (n *nfsDriver) RetentionReport(w io.Writer) error {
+	dir, err := ioutil.TempDir("", "csi-nfs-retention")
+	if err != nil {
+		return err
+	}
+	mounter := mount.New("")
+	cs := newControllerServer(n, mounter, dir, 0)
+	defer removeMountDir(mounter, dir)
+	defer cs.exports.stop()
+
+	actions, err := cs.enforceRetention(context.Background(), true)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SNAPSHOT\tVOLUME\tCREATED\tSIZE\tEXPIRED\tRESULT")
+	for _, a := range actions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", a.snapshotID, a.volumeID, a.creationTime.Format(time.RFC3339), bytefmt.ByteSize(uint64(a.sizeBytes)), a.reason, a.result)
+	}
+	if ferr := tw.Flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// removeMountDir removes the directory dir holding the mount points of
+// exports, one mount point at a time so that the exports of a failed
+// unmount are never removed through it.
+func removeMountDir(mounter mount.Interface, dir string) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		logrus.Errorf("failed to list %s: %s", dir, err)
+		return
+	}
+	for _, fi := range fis {
+		if err := mount.CleanupMountPoint(filepath.Join(dir, fi.Name()), mounter, false); err != nil {
+			logrus.Errorf("failed to remove mount point %s: %s", filepath.Join(dir, fi.Name()), err)
+		}
+	}
+	if err := os.Remove(dir); err != nil {
+		logrus.Errorf("failed to remove %s: %s", dir, err)
+	}
+}
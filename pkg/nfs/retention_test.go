@@ -0,0 +1,110 @@
+package nfs
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/utils/mount"
+)
+
+func TestRetentionPolicyExpired(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	// one snapshot a day of 1G, from the most recent one
+	var snapshots []*snapshotMetadata
+	for i, name := range []string{"d0", "d1", "d2", "d3"} {
+		snapshots = append(snapshots, &snapshotMetadata{
+			Name:         name,
+			CreationTime: now.Add(-time.Duration(i) * 24 * time.Hour),
+			SizeBytes:    1 << 30,
+		})
+	}
+
+	tests := []struct {
+		policy retentionPolicy
+		want   []string
+	}{
+		{policy: retentionPolicy{}, want: nil},
+		{policy: retentionPolicy{KeepLast: 2}, want: []string{"d2", "d3"}},
+		{policy: retentionPolicy{KeepLast: 10}, want: nil},
+		{policy: retentionPolicy{MaxAge: "36h"}, want: []string{"d2", "d3"}},
+		{policy: retentionPolicy{MaxBytes: "3G"}, want: []string{"d3"}},
+		{policy: retentionPolicy{KeepLast: 3, MaxAge: "60h"}, want: []string{"d3"}},
+		// the most recent snapshot is always kept
+		{policy: retentionPolicy{KeepLast: 1, MaxAge: "1h", MaxBytes: "1M"}, want: []string{"d1", "d2", "d3"}},
+	}
+	for _, tt := range tests {
+		expired := tt.policy.expired(snapshots, now)
+		var got []string
+		for _, m := range snapshots {
+			if _, ok := expired[m.Name]; ok {
+				got = append(got, m.Name)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v expired %q, want %q", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestEnforceRetentionKeepsReferencedSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-nfs-retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cs := newControllerServer(&nfsDriver{name: "csi-nfs", nfsSnapshotPath: "snapshots"}, mount.NewFakeMounter(nil), dir, 0)
+	defer cs.exports.stop()
+	// the mount options are part of the snapshot ids
+	vol := newNFSVolumeWithOptions("srv", "/data", "pvc", "nconnect=4")
+	snapPath, release, err := cs.snapshotPath(newNFSSnapshot(vol, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(snapPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i, name := range []string{"s0", "s1", "s2"} {
+		m := &snapshotMetadata{
+			Name:           name,
+			SourceVolumeID: vol.id,
+			CreationTime:   now.Add(-time.Duration(i) * time.Hour),
+			SizeBytes:      1,
+			Retention:      &retentionPolicy{KeepLast: 1},
+		}
+		if err := writeSnapshotMetadata(snapPath, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	release()
+
+	referenced := newNFSSnapshot(vol, "s1").id
+	cs.listSnapshotHandles = func(context.Context) (map[string]bool, error) {
+		return map[string]bool{referenced: true}, nil
+	}
+	actions, err := cs.enforceRetention(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, a := range actions {
+		got[a.name] = a.result
+	}
+	want := map[string]string{
+		"s1": "kept, referenced by a VolumeSnapshotContent",
+		"s2": "deleted",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("enforceRetention() = %v, want %v", got, want)
+	}
+	for name, exists := range map[string]bool{"s0": true, "s1": true, "s2": false} {
+		if _, err := readSnapshotMetadata(snapPath, name); (err == nil) != exists {
+			t.Errorf("snapshot %s exists = %v, want %v", name, err == nil, exists)
+		}
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"net"
 	"os"
 	"sync"
+	"time"
 
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -15,7 +17,7 @@ import (
 type NonBlockingGRPCServer interface {
 	// Start services at the endpoint
 	Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer)
-	// Waits for the service to stop
+	// Waits for the service to stop and its in-flight calls to return
 	Wait()
 	// Stops the service gracefully
 	Stop()
@@ -23,20 +25,27 @@ type NonBlockingGRPCServer interface {
 	ForceStop()
 }
 
-func NewNonBlockingGRPCServer(debug bool) NonBlockingGRPCServer {
-	return &nonBlockingGRPCServer{debug: debug}
+// NewNonBlockingGRPCServer returns a server which waits up to
+// shutdownTimeout for its in-flight calls once stopped.
+func NewNonBlockingGRPCServer(debug bool, shutdownTimeout time.Duration) NonBlockingGRPCServer {
+	return &nonBlockingGRPCServer{debug: debug, shutdownTimeout: shutdownTimeout}
 }
 
 // NonBlocking server
 type nonBlockingGRPCServer struct {
-	debug  bool
-	wg     sync.WaitGroup
-	server *grpc.Server
+	debug           bool
+	shutdownTimeout time.Duration
+	wg              sync.WaitGroup
+	inflight        sync.WaitGroup
+	server          *grpc.Server
+	listener        net.Listener
+	socket          string
 }
 
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	s.listen(endpoint, ids, cs, ns)
 	s.wg.Add(1)
-	go s.serve(endpoint, ids, cs, ns)
+	go s.serve()
 	return
 }
 
@@ -52,7 +61,7 @@ func (s *nonBlockingGRPCServer) ForceStop() {
 	s.server.Stop()
 }
 
-func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+func (s *nonBlockingGRPCServer) listen(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
 	proto, addr, err := ParseEndpoint(endpoint)
 	if err != nil {
 		logrus.Fatal(err.Error())
@@ -63,6 +72,7 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
 			logrus.Fatalf("Failed to remove %s, error: %s", addr, err.Error())
 		}
+		s.socket = addr
 	}
 
 	listener, err := net.Listen(proto, addr)
@@ -70,12 +80,13 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		logrus.Fatalf("Failed to listen: %v", err)
 	}
 
-	var opts []grpc.ServerOption
+	interceptors := []grpc.UnaryServerInterceptor{s.trackInflight}
 	if s.debug {
-		opts = append(opts, grpc.UnaryInterceptor(logGRPC))
+		interceptors = append(interceptors, logGRPC)
 	}
-	server := grpc.NewServer(opts...)
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(interceptors...))
 	s.server = server
+	s.listener = listener
 
 	if ids != nil {
 		csi.RegisterIdentityServer(server, ids)
@@ -87,6 +98,35 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		csi.RegisterNodeServer(server, ns)
 	}
 
-	logrus.Infof("Listening for connections on address: %v", listener.Addr())
-	_ = server.Serve(listener)
+}
+
+func (s *nonBlockingGRPCServer) serve() {
+	defer s.wg.Done()
+
+	logrus.Infof("Listening for connections on address: %v", s.listener.Addr())
+	_ = s.server.Serve(s.listener)
+
+	// a forced stop does not wait for the handlers still running, nor
+	// does this wait for the ones stuck on a dead mount
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(s.shutdownTimeout):
+		logrus.Warnf("in-flight calls did not return within %s, giving up on them", s.shutdownTimeout)
+	}
+	if s.socket != "" {
+		if err := os.Remove(s.socket); err != nil && !os.IsNotExist(err) {
+			logrus.Errorf("Failed to remove %s, error: %s", s.socket, err.Error())
+		}
+	}
+}
+
+func (s *nonBlockingGRPCServer) trackInflight(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	s.inflight.Add(1)
+	defer s.inflight.Done()
+	return handler(ctx, req)
 }
@@ -0,0 +1,279 @@
+package nfs
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/utils/mount"
+)
+
+// sharedExports mounts every distinct nfs export once per node under dir
+// and bind mounts the volume sub directories into publish targets. The
+// number of bind mounts of every export is tracked so that an export is
+// unmounted with its last volume.
+type sharedExports struct {
+	// mu guards refs and locks, it is never held while mounting so that a
+	// hung server only blocks the volumes of its exports
+	mu      sync.Mutex
+	mounter mount.Interface
+	dir     string
+	// versions negotiates the nfs version of export mounts
+	versions *versionNegotiator
+	// refs maps the name of an export mount under dir to its bind mounts
+	refs map[string]int
+	// locks serializes the mounts and unmounts of every export
+	locks map[string]*exportLock
+}
+
+// exportLock is the lock of an export, it is dropped once nobody holds or
+// waits for it.
+type exportLock struct {
+	mu    sync.Mutex
+	users int
+}
+
+func newSharedExports(mounter mount.Interface, dir string, versions *versionNegotiator) *sharedExports {
+	return &sharedExports{
+		mounter:  mounter,
+		dir:      dir,
+		versions: versions,
+		refs:     make(map[string]int),
+		locks:    make(map[string]*exportLock),
+	}
+}
+
+// lock takes the lock of the export name, the returned function releases
+// it.
+func (s *sharedExports) lock(name string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[name]
+	if !ok {
+		l = &exportLock{}
+		s.locks[name] = l
+	}
+	l.users++
+	s.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		s.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(s.locks, name)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// ref adds delta to the bind mounts of the export name and returns them.
+func (s *sharedExports) ref(name string, delta int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.refs[name] += delta
+	return s.refs[name]
+}
+
+// exportName returns the name of the mount point of an export, volumes
+// of the same export using different mount options get different mounts.
+func exportName(server, share string, options []string) string {
+	opts := append([]string(nil), options...)
+	sort.Strings(opts)
+	sum := sha1.Sum([]byte(exportKey(server, share) + "|" + strings.Join(opts, ",")))
+	return fmt.Sprintf("%s-%s", server, hex.EncodeToString(sum[:])[:12])
+}
+
+// rebuild recounts the bind mounts of every export mounted under dir at the
+// publish targets of driver, so that the counts survive restarts of the
+// node plugin. Other mounts of the same nfs superblock are not users of the
+// exports. Exports left without bind mounts are unmounted.
+func (s *sharedExports) rebuild(driver string) error {
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return err
+	}
+	mis, err := mount.ParseMountInfo(procMountInfo)
+	if err != nil {
+		return err
+	}
+	targets, err := driverMountPoints(driver)
+	if err != nil {
+		return err
+	}
+
+	refs := s.bindMounts(mis, targets)
+	s.mu.Lock()
+	s.refs = refs
+	s.mu.Unlock()
+
+	for name, refs := range refs {
+		logrus.Infof("shared nfs export %s has %d bind mounts", name, refs)
+		if refs == 0 {
+			unlock := s.lock(name)
+			s.unmountExport(name)
+			unlock()
+		}
+	}
+	return nil
+}
+
+// bindMounts counts the bind mounts at targets of every export mounted
+// under dir in mis.
+func (s *sharedExports) bindMounts(mis []mount.MountInfo, targets map[string]bool) map[string]int {
+	refs := make(map[string]int)
+	for _, mi := range mis {
+		if filepath.Dir(mi.MountPoint) == s.dir {
+			refs[filepath.Base(mi.MountPoint)] = 0
+		}
+	}
+	for _, mi := range mis {
+		if !targets[mi.MountPoint] {
+			continue
+		}
+		if export := s.exportOf(mis, mi); export != "" {
+			refs[export]++
+		}
+	}
+	return refs
+}
+
+// publish mounts the export of vol if needed and bind mounts the volume
+// sub directory at target, version is tried first when negotiating the nfs
+// version of the export.
+func (s *sharedExports) publish(vol *nfsVolume, options []string, version, target string, readonly bool) error {
+	name := exportName(vol.server, vol.share, options)
+	unlock := s.lock(name)
+	defer unlock()
+
+	exportPath := filepath.Join(s.dir, name)
+	if err := s.mountExport(vol, options, version, exportPath); err != nil {
+		return err
+	}
+	s.ref(name, 0)
+
+	source, err := confinedPath(exportPath, vol.subDir)
+	if err == nil {
+		_, err = os.Stat(source)
+	}
+	if err != nil {
+		if s.ref(name, 0) == 0 {
+			s.unmountExport(name)
+		}
+		return err
+	}
+
+	mo := []string{"bind"}
+	if readonly {
+		mo = append(mo, "ro")
+	}
+	if err := s.mounter.Mount(source, target, "", mo); err != nil {
+		if s.ref(name, 0) == 0 {
+			s.unmountExport(name)
+		}
+		return err
+	}
+	s.ref(name, 1)
+	return nil
+}
+
+// unpublish unmounts target and releases the export it was bound from,
+// force detaches target without touching it for hung mounts.
+func (s *sharedExports) unpublish(target string, force bool) error {
+	var export string
+	mis, err := mount.ParseMountInfo(procMountInfo)
+	if err != nil {
+		return err
+	}
+	for _, mi := range mis {
+		if mi.MountPoint == target {
+			export = s.exportOf(mis, mi)
+			break
+		}
+	}
+
+	if export == "" {
+		return unmountAndRemove(s.mounter, target, force)
+	}
+
+	unlock := s.lock(export)
+	defer unlock()
+	if err := unmountAndRemove(s.mounter, target, force); err != nil {
+		return err
+	}
+	if s.ref(export, -1) <= 0 {
+		s.unmountExport(export)
+	}
+	return nil
+}
+
+// exportOf returns the name of the export mount mi has been bound from,
+// the export with the same device and the longest root containing the
+// root of mi wins since nfs shares superblocks between exports.
+func (s *sharedExports) exportOf(mis []mount.MountInfo, mi mount.MountInfo) string {
+	var export, root string
+	for _, e := range mis {
+		if filepath.Dir(e.MountPoint) != s.dir || e.Major != mi.Major || e.Minor != mi.Minor {
+			continue
+		}
+		if !mount.PathWithinBase(mi.Root, e.Root) {
+			continue
+		}
+		if export == "" || len(e.Root) > len(root) {
+			export, root = filepath.Base(e.MountPoint), e.Root
+		}
+	}
+	return export
+}
+
+func (s *sharedExports) mountExport(vol *nfsVolume, options []string, version, path string) error {
+	notMnt, err := s.mounter.IsLikelyNotMountPoint(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(path, 0750); err != nil {
+				return err
+			}
+			notMnt = true
+		} else if mount.IsCorruptedMnt(err) {
+			logrus.Warnf("shared nfs export %s:%s at %s is stale, remounting", vol.server, vol.share, path)
+			if err := forceUnmount(s.mounter, path); err != nil {
+				return err
+			}
+			notMnt = true
+		} else {
+			return err
+		}
+	}
+	if !notMnt {
+		return nil
+	}
+
+	source := fmt.Sprintf("%s:%s", vol.server, vol.share)
+	logrus.Infof("mount shared nfs export: %s => %s(%s)", source, path, strings.Join(options, ","))
+	v, err := s.versions.mount(s.mounter, vol.server, source, path, options, version)
+	if err != nil {
+		return err
+	}
+	if v != "" {
+		logrus.Infof("mounted shared nfs export %s with version %s", source, v)
+	}
+	return nil
+}
+
+// unmountExport unmounts the export name, its lock must be held.
+func (s *sharedExports) unmountExport(name string) {
+	path := filepath.Join(s.dir, name)
+	logrus.Infof("unmount shared nfs export: %s", path)
+	if err := mount.CleanupMountPoint(path, s.mounter, false); err != nil {
+		logrus.Errorf("failed to unmount shared nfs export %s: %s", path, err)
+		return
+	}
+	s.mu.Lock()
+	delete(s.refs, name)
+	s.mu.Unlock()
+}
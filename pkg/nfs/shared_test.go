@@ -0,0 +1,79 @@
+package nfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"k8s.io/utils/mount"
+)
+
+func TestSharedExportsBindMounts(t *testing.T) {
+	s := newSharedExports(mount.NewFakeMounter(nil), "/var/lib/csi-nfs/exports", nil)
+	target := func(pod string) string {
+		return filepath.Join(kubeletPodsDir, pod, "volumes", "kubernetes.io~csi", "pv", "mount")
+	}
+	mis := []mount.MountInfo{
+		// nfs shares the superblock of the exports of a server
+		{Major: 0, Minor: 50, Root: "/data", MountPoint: "/var/lib/csi-nfs/exports/a"},
+		{Major: 0, Minor: 50, Root: "/data/team", MountPoint: "/var/lib/csi-nfs/exports/b"},
+		{Major: 0, Minor: 51, Root: "/", MountPoint: "/var/lib/csi-nfs/exports/c"},
+		{Major: 0, Minor: 50, Root: "/data/pvc-1", MountPoint: target("p1")},
+		{Major: 0, Minor: 50, Root: "/data/team/pvc-2", MountPoint: target("p2")},
+		{Major: 0, Minor: 50, Root: "/data/team/pvc-3", MountPoint: target("p3")},
+		// the volumes of other drivers and the mounts of pods are no users
+		{Major: 0, Minor: 50, Root: "/data/pvc-4", MountPoint: target("p4")},
+		{Major: 0, Minor: 50, Root: "/data/team", MountPoint: "/mnt/team"},
+	}
+	targets := map[string]bool{target("p1"): true, target("p2"): true, target("p3"): true}
+
+	got := s.bindMounts(mis, targets)
+	want := map[string]int{"a": 1, "b": 2, "c": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bindMounts() = %v, want %v", got, want)
+	}
+}
+
+func TestSharedExportsPublish(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-nfs-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mounter := mount.NewFakeMounter(nil)
+	s := newSharedExports(mounter, filepath.Join(dir, "exports"), newVersionNegotiator(nil))
+
+	options := []string{"vers=4"}
+	name := exportName("srv", "/data", options)
+	exportPath := filepath.Join(dir, "exports", name)
+	for _, v := range []string{"pvc-1", "pvc-2"} {
+		if err := os.MkdirAll(filepath.Join(exportPath, v), 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, v := range []string{"pvc-1", "pvc-2"} {
+		target := filepath.Join(dir, "target-"+v)
+		if err := s.publish(newNFSVolume("srv", "/data", v), options, "", target, false); err != nil {
+			t.Fatal(err)
+		}
+		if refs := s.ref(name, 0); refs != i+1 {
+			t.Errorf("export has %d bind mounts after publishing %s, want %d", refs, v, i+1)
+		}
+	}
+	// a failed publish leaves the export to its volumes
+	if err := s.publish(newNFSVolume("srv", "/data", "missing"), options, "", filepath.Join(dir, "target-missing"), false); err == nil {
+		t.Error("publish() of a missing volume directory succeeded")
+	}
+	if refs := s.ref(name, 0); refs != 2 {
+		t.Errorf("export has %d bind mounts after a failed publish, want 2", refs)
+	}
+	if notMnt, err := mounter.IsLikelyNotMountPoint(exportPath); err != nil || notMnt {
+		t.Errorf("export used by volumes is not mounted: %v", err)
+	}
+	if n := len(mounter.GetLog()); n != 3 {
+		t.Errorf("publish() mounted %d times, want 3", n)
+	}
+}
@@ -0,0 +1,387 @@
+package nfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/exec"
+)
+
+const (
+	// parameterIncremental is the VolumeSnapshotClass parameter asking to
+	// only archive what changed since the previous snapshot of the volume.
+	parameterIncremental = "incremental"
+	// maxSnapshotChain bounds the number of snapshots a restore replays.
+	maxSnapshotChain = 1024
+	// staleSnapshotAge is the age past which a snapshot without size is
+	// left over by a crash rather than being taken.
+	staleSnapshotAge = 24 * time.Hour
+)
+
+// snapshotMetadata describes a snapshot, it is stored next to its archive.
+// Snapshots taken before metadata existed have none and are full ones.
+type snapshotMetadata struct {
+	Name           string    `json:"name"`
+	SourceVolumeID string    `json:"sourceVolumeId"`
+	CreationTime   time.Time `json:"creationTime"`
+	// SizeBytes is the size of the archive, it is only set once the
+	// snapshot is complete
+	SizeBytes int64 `json:"sizeBytes"`
+	// Parent is the snapshot an incremental snapshot holds the changes of
+	Parent string `json:"parent,omitempty"`
+	// Retention is the retention policy of the VolumeSnapshotClass
+	Retention *retentionPolicy `json:"retention,omitempty"`
+}
+
+// manifestEntry identifies the version of a file, a file is archived again
+// when any of its fields changes.
+type manifestEntry struct {
+	Mtime int64  `json:"mtime"`
+	Size  int64  `json:"size"`
+	Inode uint64 `json:"inode"`
+	Mode  uint32 `json:"mode"`
+}
+
+// snapshotManifest lists every path of a volume at the time of a snapshot,
+// relative to the volume directory.
+type snapshotManifest map[string]manifestEntry
+
+func snapshotMetadataPath(snapPath, name string) string {
+	return filepath.Join(snapPath, name+".json")
+}
+
+func snapshotManifestPath(snapPath, name string) string {
+	return filepath.Join(snapPath, name+".manifest.gz")
+}
+
+// readSnapshotMetadata reads the metadata of the snapshot name, the error
+// satisfies os.IsNotExist for snapshots without metadata.
+func readSnapshotMetadata(snapPath, name string) (*snapshotMetadata, error) {
+	b, err := ioutil.ReadFile(snapshotMetadataPath(snapPath, name))
+	if err != nil {
+		return nil, err
+	}
+	m := &snapshotMetadata{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("failed to parse the metadata of snapshot %s: %s", name, err)
+	}
+	return m, nil
+}
+
+func writeSnapshotMetadata(snapPath string, m *snapshotMetadata) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(snapshotMetadataPath(snapPath, m.Name), b, 0644)
+}
+
+// listSnapshotMetadata returns the metadata of every snapshot of the
+// snapshot directory snapPath.
+func listSnapshotMetadata(snapPath string) ([]*snapshotMetadata, error) {
+	paths, err := filepath.Glob(filepath.Join(snapPath, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*snapshotMetadata
+	for _, p := range paths {
+		name := strings.TrimSuffix(filepath.Base(p), ".json")
+		m, err := readSnapshotMetadata(snapPath, name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		snapshots = append(snapshots, m)
+	}
+	return snapshots, nil
+}
+
+// latestSnapshot returns the most recent complete snapshot of the volume
+// volumeID which has a manifest, nil when there is none.
+func latestSnapshot(snapPath, volumeID string) (*snapshotMetadata, error) {
+	snapshots, err := listSnapshotMetadata(snapPath)
+	if err != nil {
+		return nil, err
+	}
+	var latest *snapshotMetadata
+	for _, m := range snapshots {
+		if m.SourceVolumeID != volumeID || m.SizeBytes == 0 {
+			continue
+		}
+		if _, err := os.Stat(snapshotManifestPath(snapPath, m.Name)); err != nil {
+			continue
+		}
+		if latest == nil || m.CreationTime.After(latest.CreationTime) {
+			latest = m
+		}
+	}
+	return latest, nil
+}
+
+// snapshotName returns the name of the snapshot of the CreateSnapshot
+// request name, the same for every retry of the request.
+func snapshotName(requestName string) string {
+	return uuid.NewSHA1(uuid.NameSpace_OID, []byte(requestName)).String()
+}
+
+// isStaleSnapshot reports whether the snapshot of m was left incomplete by
+// a CreateSnapshot which did not finish, rather than still being taken.
+func isStaleSnapshot(m *snapshotMetadata, now time.Time) bool {
+	return m.SizeBytes == 0 && now.Sub(m.CreationTime) > staleSnapshotAge
+}
+
+// snapshotChildren returns the names of the incremental snapshots based on
+// the snapshot name, and apart the stale ones.
+func snapshotChildren(snapPath, name string, now time.Time) ([]string, []string, error) {
+	snapshots, err := listSnapshotMetadata(snapPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	var children, stale []string
+	for _, m := range snapshots {
+		if m.Parent != name {
+			continue
+		}
+		if isStaleSnapshot(m, now) {
+			stale = append(stale, m.Name)
+		} else {
+			children = append(children, m.Name)
+		}
+	}
+	return children, stale, nil
+}
+
+// snapshotChain returns the snapshots to replay to restore the snapshot
+// name, from its full ancestor to itself.
+func snapshotChain(snapPath, name string) ([]string, error) {
+	chain := []string{name}
+	for len(chain) <= maxSnapshotChain {
+		m, err := readSnapshotMetadata(snapPath, chain[0])
+		if err != nil {
+			if os.IsNotExist(err) && len(chain) == 1 {
+				// snapshots without metadata are full ones
+				return chain, nil
+			}
+			return nil, err
+		}
+		if m.Parent == "" {
+			return chain, nil
+		}
+		chain = append([]string{m.Parent}, chain...)
+	}
+	return nil, fmt.Errorf("snapshot %s has more than %d ancestors", name, maxSnapshotChain)
+}
+
+// buildManifest lists every path under the volume directory dir.
+func buildManifest(dir string) (snapshotManifest, error) {
+	m := make(snapshotManifest)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		e := manifestEntry{
+			Mtime: fi.ModTime().UnixNano(),
+			Size:  fi.Size(),
+			Mode:  uint32(fi.Mode()),
+		}
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			e.Inode = st.Ino
+		}
+		m[rel] = e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// changedSince returns the archive members of the paths of m which are not
+// in parent or differ from it. The volume directory comes first so that
+// incremental archives start like full ones.
+func (m snapshotManifest) changedSince(parent snapshotManifest) []string {
+	var changed []string
+	for p, e := range m {
+		if p == "." {
+			continue
+		}
+		if pe, ok := parent[p]; !ok || pe != e {
+			changed = append(changed, "./"+p)
+		}
+	}
+	sort.Strings(changed)
+	return append([]string{"."}, changed...)
+}
+
+func readSnapshotManifest(snapPath, name string) (snapshotManifest, error) {
+	f, err := os.Open(snapshotManifestPath(snapPath, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	m := make(snapshotManifest)
+	if err := json.NewDecoder(zr).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to parse the manifest of snapshot %s: %s", name, err)
+	}
+	return m, nil
+}
+
+func writeSnapshotManifest(snapPath, name string, m snapshotManifest) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(m); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return writeFileAtomic(snapshotManifestPath(snapPath, name), buf.Bytes(), 0644)
+}
+
+// archiveSnapshot archives the volume directory dir into archive, only the
+// members listed are archived when members is not nil.
+func archiveSnapshot(ctx context.Context, dir, archive string, members []string) error {
+	// archives are relative to the volume directory
+	args := []string{"-zcpf", archive, "-C", dir}
+	var list []byte
+	if members == nil {
+		args = append(args, ".")
+	} else {
+		args = append(args, "--no-recursion", "--null", "-T", "-")
+		list = []byte(strings.Join(members, "\x00") + "\x00")
+	}
+	cmd := exec.New().CommandContext(ctx, "tar", args...)
+	if list != nil {
+		cmd.SetStdin(bytes.NewReader(list))
+	}
+	outBs, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), string(outBs))
+	}
+	return nil
+}
+
+// restoreSnapshot restores the snapshot name of the snapshot directory
+// snapPath into dir, replaying its incremental chain.
+func restoreSnapshot(ctx context.Context, snapPath, name, dir string) error {
+	chain, err := snapshotChain(snapPath, name)
+	if err != nil {
+		return err
+	}
+	for _, n := range chain {
+		if err := extractSnapshot(ctx, filepath.Join(snapPath, n+".tar.gz"), dir); err != nil {
+			return fmt.Errorf("failed to extract snapshot %s: %s", n, err)
+		}
+	}
+	if len(chain) == 1 {
+		return nil
+	}
+
+	// drop what was deleted between the full snapshot and this one
+	m, err := readSnapshotManifest(snapPath, name)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := m[rel]; ok {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// deleteSnapshot removes the snapshot name of the snapshot directory
+// snapPath, unless incremental snapshots depend on it. It returns gRPC
+// status errors, snapMu must be held.
+func deleteSnapshot(snapPath, name string) error {
+	children, stale, err := snapshotChildren(snapPath, name, time.Now())
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if len(children) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "snapshot %s is the parent of incremental snapshots %s", name, strings.Join(children, ", "))
+	}
+	// incomplete children would otherwise keep their parent forever
+	for _, c := range stale {
+		logrus.Warnf("removing incomplete snapshot %s of parent %s", c, name)
+		if err := removeSnapshotFiles(snapPath, c); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if err := removeSnapshotFiles(snapPath, name); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	// read-only volumes keep the extracted snapshot until they are deleted
+	if err := removeSnapshotCache(snapPath, name); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// removeSnapshotFiles removes the archive, manifest and metadata of the
+// snapshot name.
+func removeSnapshotFiles(snapPath, name string) error {
+	for _, p := range []string{
+		filepath.Join(snapPath, name+".tar.gz"),
+		snapshotManifestPath(snapPath, name),
+		snapshotMetadataPath(snapPath, name),
+	} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isIncremental reports whether the snapshots of params are incremental.
+func isIncremental(params map[string]string) (bool, error) {
+	v, ok := params[parameterIncremental]
+	if !ok {
+		return false, nil
+	}
+	incremental, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", parameterIncremental, v)
+	}
+	return incremental, nil
+}
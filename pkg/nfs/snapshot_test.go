@@ -0,0 +1,142 @@
+package nfs
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestManifestChangedSince(t *testing.T) {
+	file := manifestEntry{Mtime: 1, Size: 10, Inode: 100, Mode: 0644}
+	tests := []struct {
+		name          string
+		parent, child snapshotManifest
+		want          []string
+	}{
+		{
+			name:   "unchanged",
+			parent: snapshotManifest{".": {}, "a": file},
+			child:  snapshotManifest{".": {Mtime: 2}, "a": file},
+			want:   []string{"."},
+		},
+		{
+			name:   "added",
+			parent: snapshotManifest{".": {}, "a": file},
+			child:  snapshotManifest{".": {}, "a": file, "b": file, "d/c": file},
+			want:   []string{".", "./b", "./d/c"},
+		},
+		{
+			name:   "modified",
+			parent: snapshotManifest{"a": file, "b": file, "c": file, "d": file},
+			child: snapshotManifest{
+				"a": {Mtime: 2, Size: 10, Inode: 100, Mode: 0644},
+				"b": {Mtime: 1, Size: 11, Inode: 100, Mode: 0644},
+				"c": {Mtime: 1, Size: 10, Inode: 101, Mode: 0644},
+				"d": {Mtime: 1, Size: 10, Inode: 100, Mode: 0600},
+			},
+			want: []string{".", "./a", "./b", "./c", "./d"},
+		},
+		{
+			name:   "removed",
+			parent: snapshotManifest{".": {}, "a": file, "b": file},
+			child:  snapshotManifest{".": {}, "a": file},
+			want:   []string{"."},
+		},
+		{
+			name:   "no parent",
+			parent: nil,
+			child:  snapshotManifest{".": {}, "b": file, "a": file},
+			want:   []string{".", "./a", "./b"},
+		},
+	}
+	for _, tt := range tests {
+		got := tt.child.changedSince(tt.parent)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: changedSince = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-nfs-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, m := range []*snapshotMetadata{
+		{Name: "full", SizeBytes: 1},
+		{Name: "inc1", Parent: "full", SizeBytes: 1},
+		{Name: "inc2", Parent: "inc1", SizeBytes: 1},
+		{Name: "orphan", Parent: "missing", SizeBytes: 1},
+		{Name: "loop1", Parent: "loop2", SizeBytes: 1},
+		{Name: "loop2", Parent: "loop1", SizeBytes: 1},
+	} {
+		if err := writeSnapshotMetadata(dir, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		want []string
+		err  bool
+	}{
+		{name: "full", want: []string{"full"}},
+		{name: "inc1", want: []string{"full", "inc1"}},
+		{name: "inc2", want: []string{"full", "inc1", "inc2"}},
+		// snapshots without metadata are full ones
+		{name: "legacy", want: []string{"legacy"}},
+		{name: "orphan", err: true},
+		{name: "loop1", err: true},
+	}
+	for _, tt := range tests {
+		got, err := snapshotChain(dir, tt.name)
+		if tt.err {
+			if err == nil {
+				t.Errorf("snapshotChain(%q) = %q, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("snapshotChain(%q) failed: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("snapshotChain(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotChildren(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-nfs-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	for _, m := range []*snapshotMetadata{
+		{Name: "full", CreationTime: now.Add(-72 * time.Hour), SizeBytes: 1},
+		{Name: "done", Parent: "full", CreationTime: now.Add(-48 * time.Hour), SizeBytes: 1},
+		{Name: "taking", Parent: "full", CreationTime: now.Add(-time.Hour)},
+		{Name: "crashed", Parent: "full", CreationTime: now.Add(-48 * time.Hour)},
+	} {
+		if err := writeSnapshotMetadata(dir, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	children, stale, err := snapshotChildren(dir, "full", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"done", "taking"}; !reflect.DeepEqual(children, want) {
+		t.Errorf("children = %q, want %q", children, want)
+	}
+	if want := []string{"crashed"}; !reflect.DeepEqual(stale, want) {
+		t.Errorf("stale children = %q, want %q", stale, want)
+	}
+}
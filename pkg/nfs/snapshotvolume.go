@@ -0,0 +1,204 @@
+package nfs
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/exec"
+)
+
+// parameterReadOnlySnapshotVolume is the StorageClass parameter asking to
+// expose snapshots as read-only volumes instead of restoring a copy.
+const parameterReadOnlySnapshotVolume = "readOnlySnapshotVolume"
+
+// isReadOnlySnapshotVolume reports whether the volumes of params are
+// read-only views of their snapshot.
+func isReadOnlySnapshotVolume(params map[string]string) (bool, error) {
+	v, ok := params[parameterReadOnlySnapshotVolume]
+	if !ok {
+		return false, nil
+	}
+	ro, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q", parameterReadOnlySnapshotVolume, v)
+	}
+	return ro, nil
+}
+
+// snapshotArchive returns the path of the archive of snap in its snapshot
+// directory snapPath.
+func snapshotArchive(snapPath string, snap *nfsSnapshot) string {
+	return filepath.Join(snapPath, snap.name+".tar.gz")
+}
+
+// snapshotRefsDir returns the directory holding one file per read-only
+// volume of snap, the extracted snapshot is removed with the last of them
+// once the snapshot is deleted.
+func snapshotRefsDir(snapPath, name string) string {
+	return filepath.Join(snapPath, name+".refs")
+}
+
+// createSnapshotVolume provisions the read-only volume name of the snapshot
+// snapshotID. The snapshot is extracted once next to its archive and every
+// volume of it mounts that directory.
+func (cs *ControllerServer) createSnapshotVolume(ctx context.Context, name, snapshotID string, caps []*csi.VolumeCapability) (*nfsVolume, error) {
+	for _, c := range caps {
+		if !isReadOnlyAccessMode(c.GetAccessMode().GetMode()) {
+			return nil, status.Errorf(codes.InvalidArgument, "%s volumes require a reader only access mode, not %s", parameterReadOnlySnapshotVolume, c.GetAccessMode().GetMode())
+		}
+	}
+	snap, err := cs.Driver.parseSnapshotID(snapshotID)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	snapPath, release, err := cs.snapshotPath(snap)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	archive := snapshotArchive(snapPath, snap)
+	if _, err := os.Stat(archive); err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "snapshot %q does not exist", snapshotID)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	cache := filepath.Join(snapPath, snap.name)
+	var tmp string
+	if _, err := os.Stat(cache); os.IsNotExist(err) {
+		// extract outside of the lock into a private directory, concurrent
+		// extractions of the same snapshot only waste work
+		tmp = filepath.Join(snapPath, snap.name+".tmp-"+uuid.NewUUID().String())
+		if err := os.Mkdir(tmp, 0755); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		defer os.RemoveAll(tmp)
+		logrus.Infof("CreateVolume: extracting snapshot %s for read-only volumes", snap.id)
+		if err := restoreSnapshot(ctx, snapPath, snap.name, tmp); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	cs.snapMu.Lock()
+	defer cs.snapMu.Unlock()
+	if _, err := os.Stat(cache); os.IsNotExist(err) && tmp != "" {
+		if err := os.Rename(tmp, cache); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	// the snapshot may have been deleted meanwhile, its directory then goes
+	// away with its last volume or now when it has none
+	if _, err := os.Stat(archive); err != nil {
+		if os.IsNotExist(err) {
+			if err := removeSnapshotCache(snapPath, snap.name); err != nil {
+				logrus.Warnf("failed to remove the extracted snapshot %s: %s", snap.name, err)
+			}
+			return nil, status.Errorf(codes.NotFound, "snapshot %q does not exist", snapshotID)
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	refs := snapshotRefsDir(snapPath, snap.name)
+	if err := os.MkdirAll(refs, 0700); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := ioutil.WriteFile(filepath.Join(refs, name), nil, 0600); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return newSnapshotNFSVolume(snap, cs.Driver.nfsSnapshotPath, name), nil
+}
+
+// deleteSnapshotVolume drops the read-only snapshot volume vol, whose
+// directory is at volPath, and the extracted snapshot when it was the last
+// volume of a deleted snapshot.
+func (cs *ControllerServer) deleteSnapshotVolume(vol *nfsVolume, volPath string) error {
+	cs.snapMu.Lock()
+	defer cs.snapMu.Unlock()
+
+	snapPath := filepath.Dir(volPath)
+	if err := os.Remove(filepath.Join(snapshotRefsDir(snapPath, vol.subDir), vol.snapshotRef)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	_, err := os.Stat(filepath.Join(snapPath, vol.subDir+".tar.gz"))
+	if os.IsNotExist(err) {
+		return removeSnapshotCache(snapPath, vol.subDir)
+	}
+	return err
+}
+
+// removeSnapshotCache removes the extracted snapshot name of the snapshot
+// directory snapPath unless read-only volumes still use it, snapMu must be
+// held.
+func removeSnapshotCache(snapPath, name string) error {
+	refs := snapshotRefsDir(snapPath, name)
+	fis, err := ioutil.ReadDir(refs)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(fis) > 0 {
+		logrus.Infof("snapshot %s is kept extracted for %d read-only volumes", name, len(fis))
+		return nil
+	}
+	if err := os.RemoveAll(filepath.Join(snapPath, name)); err != nil {
+		return err
+	}
+	return os.RemoveAll(refs)
+}
+
+// extractSnapshot extracts the snapshot archive into dir.
+func extractSnapshot(ctx context.Context, archive, dir string) error {
+	depth, err := archiveDepth(ctx, archive)
+	if err != nil {
+		return err
+	}
+	args := []string{"-zxpf", archive, "-C", dir}
+	if depth > 0 {
+		args = append(args, "--strip-components="+strconv.Itoa(depth))
+	}
+	outBs, err := exec.New().CommandContext(ctx, "tar", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), string(outBs))
+	}
+	return nil
+}
+
+// archiveDepth returns the number of leading path components of the members
+// of a snapshot archive. Archives are relative to their volume directory,
+// legacy ones hold the local path of the volume directory instead.
+func archiveDepth(ctx context.Context, archive string) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cmd := exec.New().CommandContext(ctx, "tar", "-ztf", archive)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	// the first member is the volume directory itself
+	first, err := bufio.NewReader(out).ReadString('\n')
+	cancel()
+	_ = cmd.Wait()
+	first = strings.Trim(strings.TrimSpace(first), "/")
+	if first == "" {
+		return 0, fmt.Errorf("failed to list snapshot archive %s: %v", archive, err)
+	}
+	if first == "." {
+		return 0, nil
+	}
+	return len(strings.Split(first, "/")), nil
+}
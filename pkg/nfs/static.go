@@ -0,0 +1,155 @@
+package nfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// volumeContextPreProvisioned marks the volume context of volumes imported
+// from existing directories.
+const volumeContextPreProvisioned = "preProvisioned"
+
+// isPreProvisioned reports whether a volume was imported.
+func isPreProvisioned(volContext map[string]string) bool {
+	return volContext[volumeContextPreProvisioned] == "true"
+}
+
+// validatePreProvisioned verifies the handcrafted volume context of an
+// imported volume, its volume id must be static and point at the same
+// directory as the context. Any other id would let DeleteVolume remove the
+// imported data.
+func (n *nfsDriver) validatePreProvisioned(volumeID string, volContext map[string]string) error {
+	for _, key := range []string{"server", "share"} {
+		if volContext[key] == "" {
+			return fmt.Errorf("pre-provisioned volume context must contain %s", key)
+		}
+	}
+	if err := validateServer(volContext["server"]); err != nil {
+		return err
+	}
+	if err := validateShare(volContext["share"]); err != nil {
+		return err
+	}
+	if !strings.Contains(volumeID, volumeIDSeparator) {
+		return fmt.Errorf("pre-provisioned volume id %q is not static, generate it with csi-nfs import", volumeID)
+	}
+
+	vol, err := n.parseVolumeID(volumeID)
+	if err != nil {
+		return err
+	}
+	if !vol.static {
+		return fmt.Errorf("pre-provisioned volume id %q is not static", volumeID)
+	}
+	if !sameNFSSource(vol.source(), nfsSource(volContext)) {
+		return fmt.Errorf("volume id %q does not match %s", volumeID, nfsSource(volContext))
+	}
+	return nil
+}
+
+// StaticVolume describes an existing directory to import as a volume.
+type StaticVolume struct {
+	// Name of the PersistentVolume, derived from Path when empty
+	Name         string
+	Server       string
+	Path         string
+	Capacity     string
+	AccessModes  []string
+	StorageClass string
+	MountOptions string
+}
+
+var (
+	pvNameInvalid = regexp.MustCompile(`[^a-z0-9-]+`)
+	pvNameRegexp  = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+)
+
+var pvTemplate = template.Must(template.New("pv").Funcs(template.FuncMap{"quote": quote}).Parse(`apiVersion: v1
+kind: PersistentVolume
+metadata:
+  name: {{ quote .Name }}
+spec:
+  capacity:
+    storage: {{ quote .Capacity }}
+  accessModes:
+{{- range .AccessModes }}
+    - {{ quote . }}
+{{- end }}
+  # imported volumes are never deleted by the driver
+  persistentVolumeReclaimPolicy: Retain
+  storageClassName: {{ quote .StorageClass }}
+{{- if .MountOptions }}
+  mountOptions:
+{{- range .MountOptions }}
+    - {{ quote . }}
+{{- end }}
+{{- end }}
+  csi:
+    driver: {{ quote .Driver }}
+    volumeHandle: {{ quote .VolumeHandle }}
+    volumeAttributes:
+      server: {{ quote .Server }}
+      share: {{ quote .Share }}
+      {{ .PreProvisioned }}: "true"
+`))
+
+// Manifest returns the PersistentVolume manifest of v for the driver name.
+func (v StaticVolume) Manifest(driver string) (string, error) {
+	if err := validateServer(v.Server); err != nil {
+		return "", err
+	}
+	if err := validateShare(v.Path); err != nil {
+		return "", err
+	}
+	path := filepath.Clean(v.Path)
+	vol := newStaticNFSVolume(v.Server, filepath.Dir(path), filepath.Base(path))
+	if err := validateName(vol.subDir); err != nil {
+		return "", fmt.Errorf("path %q has no volume directory: %s", path, err)
+	}
+	if err := validateID(vol.id); err != nil {
+		return "", err
+	}
+
+	name := v.Name
+	if name == "" {
+		name = strings.Trim(pvNameInvalid.ReplaceAllString(strings.ToLower(vol.subDir), "-"), "-")
+		name = strings.TrimRight("nfs-"+name, "-")
+	}
+	if len(name) > 253 || !pvNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid PersistentVolume name %q", name)
+	}
+
+	mo := splitMountOptions(v.MountOptions)
+	if err := checkMountOptions(mo); err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err := pvTemplate.Execute(&buf, map[string]interface{}{
+		"Name":           name,
+		"Capacity":       v.Capacity,
+		"AccessModes":    v.AccessModes,
+		"StorageClass":   v.StorageClass,
+		"MountOptions":   mo,
+		"Driver":         driver,
+		"VolumeHandle":   vol.id,
+		"Server":         vol.server,
+		"Share":          filepath.Join(vol.share, vol.subDir),
+		"PreProvisioned": volumeContextPreProvisioned,
+	})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// quote returns s as a double quoted yaml string.
+func quote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,408 @@
+package nfs
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/utils/exec"
+	"k8s.io/utils/mount"
+)
+
+const (
+	// volumeContextTransport is the StorageClass parameter selecting the
+	// transport of node mounts, plain by default.
+	volumeContextTransport = "transport"
+	// volumeContextTLSPort is the StorageClass parameter holding the port of
+	// the TLS endpoint tunnels of the server connect to.
+	volumeContextTLSPort = "tlsPort"
+
+	transportTLS  = "tls"
+	transportMTLS = "mtls"
+
+	// defaultTLSPort is the port of the TLS endpoint of nfs servers.
+	defaultTLSPort = "20049"
+)
+
+const (
+	// tlsTransportAuto mounts with xprtsec when the kernel supports it and
+	// through a tunnel otherwise.
+	tlsTransportAuto = "auto"
+	// tlsTransportKernel always mounts with xprtsec, certificates come from
+	// the tlshd configuration of the node.
+	tlsTransportKernel = "kernel"
+	// tlsTransportTunnel always mounts through a tunnel.
+	tlsTransportTunnel = "tunnel"
+)
+
+// Secret keys of the certificates of TLS tunnels.
+const (
+	tlsSecretCA   = "ca.crt"
+	tlsSecretCert = "tls.crt"
+	tlsSecretKey  = "tls.key"
+)
+
+const (
+	// tunnelAddr is the address tunnels listen on.
+	tunnelAddr = "127.0.0.1"
+	// tunnelStartAttempts bounds the ports tried when creating a tunnel.
+	tunnelStartAttempts = 3
+)
+
+// validateTransport verifies the transport parameters of a volume.
+func validateTransport(params map[string]string) error {
+	switch t := params[volumeContextTransport]; t {
+	case "", transportTLS, transportMTLS:
+	default:
+		return fmt.Errorf("unsupported transport %q, must be %s or %s", t, transportTLS, transportMTLS)
+	}
+	if p := params[volumeContextTLSPort]; p != "" {
+		if err := numberIn(1, 65535)(p); err != nil {
+			return fmt.Errorf("invalid %s %q: %s", volumeContextTLSPort, p, err)
+		}
+	}
+	return nil
+}
+
+// validateTransport verifies the node can mount a volume with the transport
+// of its volume context.
+func (ns *NodeServer) validateTransport(volContext map[string]string) error {
+	if err := validateTransport(volContext); err != nil {
+		return err
+	}
+	transport := volContext[volumeContextTransport]
+	if transport != "" && ns.publishMode(volContext) == nodeMountModeShared {
+		return fmt.Errorf("%s transport is not supported in the %s node mount mode", transport, nodeMountModeShared)
+	}
+	return nil
+}
+
+// kernelSupportsTLS reports whether the kernel knows the xprtsec mount
+// option, which appeared in linux 6.5.
+func kernelSupportsTLS() bool {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return false
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(b)), ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	minor, err := strconv.Atoi(strings.TrimRightFunc(parts[1], func(r rune) bool { return r < '0' || r > '9' }))
+	if err != nil {
+		return false
+	}
+	return major > 6 || major == 6 && minor >= 5
+}
+
+// mountTLS mounts the nfs export of a volume at target encrypting its
+// traffic, with xprtsec when the kernel supports it and else through a
+// tunnel to the TLS endpoint of the server.
+func (ns *NodeServer) mountTLS(volContext, secrets map[string]string, target string, options []string) (string, error) {
+	server, source := volContext["server"], nfsSource(volContext)
+	transport := volContext[volumeContextTransport]
+	mode := ns.Driver.tlsTransport
+
+	if mode == tlsTransportKernel || mode == tlsTransportAuto && kernelSupportsTLS() {
+		mo := append(append([]string(nil), options...), "xprtsec="+transport)
+		v, err := ns.versions.mount(ns.mounter, server, source, target, mo, volContext[volumeContextNFSVersion])
+		if err == nil || mode == tlsTransportKernel || !strings.Contains(strings.ToLower(err.Error()), "invalid argument") {
+			return v, err
+		}
+		logrus.Warnf("mount with xprtsec=%s failed, falling back to a tunnel: %s", transport, err)
+	}
+
+	if vers, ok := mountOptionValue(options, "vers"); ok && !strings.HasPrefix(vers, "4") {
+		return "", fmt.Errorf("tunneled mounts require nfs version 4, vers=%s requested", vers)
+	}
+	port := volContext[volumeContextTLSPort]
+	if port == "" {
+		port = defaultTLSPort
+	}
+
+	var v string
+	err := ns.tunnels.with(server, port, transport == transportMTLS, secrets, func(local int) error {
+		mo := append(append([]string(nil), options...), "proto=tcp", fmt.Sprintf("port=%d", local))
+		var err error
+		v, err = ns.versions.mount(ns.mounter, server, tunnelAddr+":"+volContext["share"], target, mo, volContext[volumeContextNFSVersion])
+		return err
+	})
+	return v, err
+}
+
+// tlsTunnels runs a stunnel process per nfs server endpoint and set of
+// certificates, every tunnel listens on a local port nfs mounts connect to.
+// The state of every tunnel lives in its own directory under dir, so that
+// tunnels are restarted on the same port when the node plugin restarts and
+// the mounts using them recover.
+type tlsTunnels struct {
+	mu  sync.Mutex
+	dir string
+	// pending counts the mounts in progress of every tunnel
+	pending map[string]int
+}
+
+func newTLSTunnels(dir string) *tlsTunnels {
+	return &tlsTunnels{
+		dir:     dir,
+		pending: make(map[string]int),
+	}
+}
+
+// tunnelName returns the directory name of the tunnel to server:port using
+// the certificates of secrets.
+func tunnelName(server, port string, mtls bool, secrets map[string]string) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s:%s|%t", server, port, mtls)
+	for _, k := range []string{tlsSecretCA, tlsSecretCert, tlsSecretKey} {
+		fmt.Fprintf(h, "|%s", secrets[k])
+	}
+	return fmt.Sprintf("%s-%s", server, hex.EncodeToString(h.Sum(nil))[:12])
+}
+
+// with runs fn with the local port of the tunnel to server:port, which is
+// started if needed and not collected while fn runs.
+func (t *tlsTunnels) with(server, port string, mtls bool, secrets map[string]string, fn func(local int) error) error {
+	name := tunnelName(server, port, mtls, secrets)
+	t.mu.Lock()
+	local, err := t.start(name, server, port, mtls, secrets)
+	if err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	t.pending[name]++
+	t.mu.Unlock()
+
+	err = fn(local)
+
+	t.mu.Lock()
+	t.pending[name]--
+	if t.pending[name] <= 0 {
+		delete(t.pending, name)
+	}
+	t.mu.Unlock()
+	return err
+}
+
+// start makes sure the tunnel name is running and returns its local port,
+// the tunnel is created when it does not exist. Callers must hold t.mu.
+func (t *tlsTunnels) start(name, server, port string, mtls bool, secrets map[string]string) (int, error) {
+	dir := filepath.Join(t.dir, name)
+	if local, err := tunnelPort(dir); err == nil {
+		return local, runTunnel(dir)
+	}
+
+	if mtls && (secrets[tlsSecretCert] == "" || secrets[tlsSecretKey] == "") {
+		return 0, fmt.Errorf("mtls transport requires %s and %s secrets", tlsSecretCert, tlsSecretKey)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+
+	conf := []string{
+		"foreground = no",
+		"pid = " + filepath.Join(dir, "stunnel.pid"),
+		"[nfs]",
+		"client = yes",
+		"connect = " + net.JoinHostPort(server, port),
+		"verifyChain = yes",
+	}
+	if net.ParseIP(server) != nil {
+		conf = append(conf, "checkIP = "+server)
+	} else {
+		conf = append(conf, "checkHost = "+server)
+	}
+	if ca := secrets[tlsSecretCA]; ca != "" {
+		if err := writeSecretFile(filepath.Join(dir, tlsSecretCA), ca); err != nil {
+			return 0, err
+		}
+		conf = append(conf, "CAfile = "+filepath.Join(dir, tlsSecretCA))
+	} else {
+		conf = append(conf, "CAfile = /etc/ssl/certs/ca-certificates.crt")
+	}
+	if mtls {
+		for _, k := range []string{tlsSecretCert, tlsSecretKey} {
+			if err := writeSecretFile(filepath.Join(dir, k), secrets[k]); err != nil {
+				return 0, err
+			}
+		}
+		conf = append(conf, "cert = "+filepath.Join(dir, tlsSecretCert), "key = "+filepath.Join(dir, tlsSecretKey))
+	}
+
+	// the free port may be taken before stunnel binds it, another one is
+	// tried then
+	var err error
+	for attempt := 1; attempt <= tunnelStartAttempts; attempt++ {
+		var local int
+		local, err = freePort()
+		if err != nil {
+			return 0, err
+		}
+		accept := fmt.Sprintf("accept = %s:%d", tunnelAddr, local)
+		if err := ioutil.WriteFile(filepath.Join(dir, "stunnel.conf"), []byte(strings.Join(append(conf, accept), "\n")+"\n"), 0600); err != nil {
+			return 0, err
+		}
+		if err = runTunnel(dir); err != nil {
+			logrus.Warnf("attempt %d to start tls tunnel %s on port %d failed: %s", attempt, name, local, err)
+			continue
+		}
+		// the port is written once stunnel listens, a tunnel without it is
+		// incomplete
+		if err := ioutil.WriteFile(filepath.Join(dir, "port"), []byte(strconv.Itoa(local)), 0600); err != nil {
+			return 0, err
+		}
+		logrus.Infof("created tls tunnel %s => %s on port %d", name, net.JoinHostPort(server, port), local)
+		return local, nil
+	}
+	return 0, err
+}
+
+// rebuild restarts the tunnels left by a previous run of the node plugin
+// and removes the unused ones.
+func (t *tlsTunnels) rebuild() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := os.MkdirAll(t.dir, 0700); err != nil {
+		return err
+	}
+	names, err := t.names()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		dir := filepath.Join(t.dir, name)
+		if _, err := tunnelPort(dir); err != nil {
+			continue
+		}
+		if err := runTunnel(dir); err != nil {
+			logrus.Errorf("failed to restart tls tunnel %s: %s", name, err)
+		}
+	}
+	return t.collectLocked()
+}
+
+// collect stops and removes the tunnels no nfs mount uses anymore.
+func (t *tlsTunnels) collect() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.collectLocked()
+}
+
+func (t *tlsTunnels) collectLocked() error {
+	names, err := t.names()
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	mis, err := mount.ParseMountInfo(procMountInfo)
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, mi := range mis {
+		if !strings.HasPrefix(mi.FsType, "nfs") {
+			continue
+		}
+		if addr, _ := mountOptionValue(mi.SuperOptions, "addr"); addr != tunnelAddr {
+			continue
+		}
+		if port, ok := mountOptionValue(mi.SuperOptions, "port"); ok {
+			used[port] = true
+		}
+	}
+
+	for _, name := range names {
+		dir := filepath.Join(t.dir, name)
+		local, err := tunnelPort(dir)
+		if t.pending[name] > 0 || err == nil && used[strconv.Itoa(local)] {
+			continue
+		}
+		logrus.Infof("removing unused tls tunnel %s", name)
+		if pid, ok := tunnelRunning(dir); ok {
+			_ = syscall.Kill(pid, syscall.SIGTERM)
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *tlsTunnels) names() ([]string, error) {
+	infos, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// runTunnel starts the stunnel of dir unless it is running already,
+// stunnel returns once it listens.
+func runTunnel(dir string) error {
+	if _, ok := tunnelRunning(dir); ok {
+		return nil
+	}
+	out, err := exec.New().Command("stunnel", filepath.Join(dir, "stunnel.conf")).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to start tls tunnel %s: %s: %s", filepath.Base(dir), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func tunnelPort(dir string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "port"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// tunnelRunning returns the pid of the stunnel of dir and whether it is
+// running, the pid of a previous run may have been reused by now.
+func tunnelRunning(dir string) (int, bool) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "stunnel.pid"))
+	if err != nil {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, false
+	}
+	comm, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	return pid, err == nil && strings.TrimSpace(string(comm)) == "stunnel"
+}
+
+// freePort returns a local port nothing listens on, it may be taken again
+// before it is bound.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", tunnelAddr+":0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -2,8 +2,11 @@ package nfs
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -14,13 +17,29 @@ import (
 	"k8s.io/utils/mount"
 )
 
-func NewIdentityServer(d *nfsDriver) *IdentityServer {
+func NewIdentityServer(d *nfsDriver, cs *ControllerServer) *IdentityServer {
 	return &IdentityServer{
-		Driver: d,
+		Driver:     d,
+		controller: cs,
 	}
 }
 
 func NewControllerServer(d *nfsDriver) *ControllerServer {
+	// the share is mounted on first use and remounted whenever it goes away
+	mounter := mount.New("")
+	cs := newControllerServer(d, mounter, d.nfsExportMountDir, d.nfsExportIdleTimeout)
+	// without a default share every export comes from StorageClass or
+	// backend parameters
+	if d.nfsServer != "" {
+		cs.exports.pin(d.nfsServer, d.nfsSharePoint, d.nfsLocalMountOptions, d.nfsLocalMountPoint)
+	}
+	go cs.exports.run()
+	return cs
+}
+
+// newControllerServer returns a controller server mounting exports under
+// dir, which unmounts them after idleTimeout.
+func newControllerServer(d *nfsDriver, mounter mount.Interface, dir string, idleTimeout time.Duration) *ControllerServer {
 	if d.nfsLocalMountOptions == "" {
 		// default mount options
 		d.nfsLocalMountOptions = "rw,soft,timeo=10,retry=3,vers=4"
@@ -28,36 +47,96 @@ func NewControllerServer(d *nfsDriver) *ControllerServer {
 	if !strings.Contains(d.nfsLocalMountOptions, "rw") {
 		logrus.Warn("nfs server is not mounted with rw mode, volume creation may fail")
 	}
-	_, err := os.Stat(d.nfsLocalMountPoint)
-	if err != nil {
-		if os.IsNotExist(err) {
-			err = os.MkdirAll(d.nfsLocalMountPoint, 0755)
-			if err != nil {
-				logrus.Fatalf("failed to create local mount point: %s", err)
-			}
-		} else {
-			logrus.Fatalf("failed to create local mount point: %s", err)
-		}
-	}
-	mounter := mount.New("")
-	source := fmt.Sprintf("%s:%s", d.nfsServer, d.nfsSharePoint)
-	logrus.Infof("mount local nfs: %s => %s(%s)", source, d.nfsLocalMountPoint, d.nfsLocalMountOptions)
-	err = mounter.Mount(source, d.nfsLocalMountPoint, "nfs", strings.Split(d.nfsLocalMountOptions, ","))
-	if err != nil {
-		logrus.Fatalf("failed to mount [%s:%s] to local mount point: %s:%s", d.nfsServer, d.nfsSharePoint, d.nfsLocalMountPoint, err)
+
+	versions := newVersionNegotiator(d.nfsVersions)
+	if versions.enabled() {
+		// the version of the default options would disable the negotiation
+		d.nfsLocalMountOptions = strings.Join(withoutVersion(splitMountOptions(d.nfsLocalMountOptions)), ",")
+		logrus.Infof("negotiating nfs versions %s", strings.Join(d.nfsVersions, ","))
 	}
 
 	return &ControllerServer{
-		Driver:  d,
-		mounter: mounter,
+		Driver:              d,
+		mounter:             mounter,
+		exports:             newExportManager(mounter, dir, d.nfsLocalMountOptions, idleTimeout, versions),
+		listSnapshotHandles: inClusterSnapshotHandles(d.name),
+		retentionStop:       make(chan struct{}),
+		retentionDone:       make(chan struct{}),
+	}
+}
+
+// stop stops enforcing retention policies and unmounts the exports no
+// operation uses anymore, it gives up after timeout since retention or
+// checks stuck on a hung server may hold an export.
+func (cs *ControllerServer) stop(timeout time.Duration) {
+	// the deadline stays closed once reached, unlike a timer channel
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	close(cs.retentionStop)
+	select {
+	case <-cs.retentionDone:
+	case <-ctx.Done():
+		logrus.Warnf("snapshot retention did not stop within %s", timeout)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		cs.exports.stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logrus.Warnf("nfs exports were not unmounted within %s, giving up on them", timeout)
 	}
 }
 
 func NewNodeServer(n *nfsDriver) *NodeServer {
-	return &NodeServer{
-		Driver:  n,
-		mounter: mount.New(""),
+	if err := validateNodeID(n.nodeID); err != nil {
+		logrus.Fatalf("invalid --nodeid: %s", err)
 	}
+
+	mounter := mount.New("")
+	versions := newVersionNegotiator(n.nfsVersions)
+
+	var shared *sharedExports
+	switch n.nodeMountMode {
+	case nodeMountModeDirect, nodeMountModeStage:
+		logrus.Infof("node mount mode: %s", n.nodeMountMode)
+	case nodeMountModeShared:
+		logrus.Infof("node mount mode: %s", n.nodeMountMode)
+		shared = newSharedExports(mounter, filepath.Join(n.nodeDataDir, "exports"), versions)
+		if err := shared.rebuild(n.name); err != nil {
+			logrus.Fatalf("failed to rebuild shared nfs exports: %s", err)
+		}
+	default:
+		logrus.Fatalf("unknown node mount mode: %s", n.nodeMountMode)
+	}
+
+	switch n.tlsTransport {
+	case tlsTransportAuto, tlsTransportKernel, tlsTransportTunnel:
+		logrus.Infof("tls transport: %s", n.tlsTransport)
+	default:
+		logrus.Fatalf("unknown tls transport: %s", n.tlsTransport)
+	}
+	tunnels := newTLSTunnels(filepath.Join(n.nodeDataDir, "tunnel"))
+	if err := tunnels.rebuild(); err != nil {
+		logrus.Fatalf("failed to rebuild tls tunnels: %s", err)
+	}
+
+	ns := &NodeServer{
+		Driver:   n,
+		mounter:  mounter,
+		shared:   shared,
+		versions: versions,
+		krb5:     newKrb5Credentials(filepath.Join(n.nodeDataDir, "krb5")),
+		tunnels:  tunnels,
+		ops:      newOperations(n.mountTimeout),
+	}
+	// a hung mount must not delay the registration of the node plugin
+	go ns.reconcile()
+	go ns.krb5.run(krb5RenewInterval)
+	return ns
 }
 
 func NewControllerServiceCapability(cap csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
@@ -91,3 +170,26 @@ func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h
 	}
 	return resp, err
 }
+
+// writeFileAtomic replaces path with data and the permissions perm, readers
+// see either the previous file or the new one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,133 @@
+package nfs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/utils/mount"
+)
+
+const (
+	// maxIDLength bounds whole volume and snapshot ids.
+	maxIDLength = 1024
+	// maxNameLength bounds the directory or file name part of an id, it is
+	// the NAME_MAX of most filesystems.
+	maxNameLength = 255
+)
+
+// validateID rejects ids which are empty or too long.
+func validateID(id string) error {
+	if id == "" {
+		return fmt.Errorf("id is empty")
+	}
+	if len(id) > maxIDLength {
+		return fmt.Errorf("id is longer than %d bytes", maxIDLength)
+	}
+	return nil
+}
+
+// validateName rejects names which would not resolve to a single entry of
+// the directory they are joined to.
+func validateName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("name is empty")
+	case len(name) > maxNameLength:
+		return fmt.Errorf("name %q is longer than %d bytes", name, maxNameLength)
+	case name == "." || name == "..":
+		return fmt.Errorf("name %q is not allowed", name)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return fmt.Errorf("name %q must not contain path separators", name)
+	case strings.Contains(name, volumeIDSeparator):
+		return fmt.Errorf("name %q must not contain %q", name, volumeIDSeparator)
+	}
+	return nil
+}
+
+// validateServer rejects servers which cannot be part of a nfs source.
+func validateServer(server string) error {
+	if server == "" {
+		return fmt.Errorf("server is empty")
+	}
+	if strings.ContainsAny(server, "/ \t\n\x00") || strings.Contains(server, volumeIDSeparator) {
+		return fmt.Errorf("server %q is invalid", server)
+	}
+	return nil
+}
+
+// validateShare rejects shares which are not clean absolute paths.
+func validateShare(share string) error {
+	if !filepath.IsAbs(share) {
+		return fmt.Errorf("share %q must be an absolute path", share)
+	}
+	if strings.ContainsAny(share, "\x00") || strings.Contains(share, volumeIDSeparator) {
+		return fmt.Errorf("share %q is invalid", share)
+	}
+	for _, p := range strings.Split(share, "/") {
+		if p == ".." {
+			return fmt.Errorf("share %q must not contain '..'", share)
+		}
+	}
+	return nil
+}
+
+// confinedPath joins name to root and makes sure the result stays inside
+// root once symlinks are resolved. The entry itself must not be a symlink,
+// so that removing it can never reach outside of root.
+func confinedPath(root, name string) (string, error) {
+	if err := validateName(name); err != nil {
+		return "", err
+	}
+
+	p := filepath.Join(root, name)
+	info, err := os.Lstat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("%s is a symlink", p)
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	if !mount.PathWithinBase(realPath, realRoot) {
+		return "", fmt.Errorf("%s resolves outside of %s", p, root)
+	}
+	return p, nil
+}
+
+// confinedDir joins the trusted relative directory dir to root and makes
+// sure the result stays inside root once symlinks are resolved.
+func confinedDir(root, dir string) (string, error) {
+	p := filepath.Join(root, dir)
+	if !mount.PathWithinBase(p, root) {
+		return "", fmt.Errorf("%s is outside of %s", p, root)
+	}
+
+	realPath, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	if !mount.PathWithinBase(realPath, realRoot) {
+		return "", fmt.Errorf("%s resolves outside of %s", p, root)
+	}
+	return p, nil
+}
@@ -0,0 +1,36 @@
+package nfs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	tests := []struct {
+		name string
+		err  bool
+	}{
+		{name: "pvc-1"},
+		{name: ".hidden"},
+		{name: "a..b"},
+		{name: strings.Repeat("a", maxNameLength)},
+		{name: "", err: true},
+		{name: strings.Repeat("a", maxNameLength+1), err: true},
+		{name: ".", err: true},
+		{name: "..", err: true},
+		{name: "a/b", err: true},
+		{name: "../etc", err: true},
+		{name: `a\b`, err: true},
+		{name: "a\x00b", err: true},
+		{name: "a#b", err: true},
+	}
+	for _, tt := range tests {
+		err := validateName(tt.name)
+		if tt.err && err == nil {
+			t.Errorf("validateName(%q) succeeded, want an error", tt.name)
+		}
+		if !tt.err && err != nil {
+			t.Errorf("validateName(%q) failed: %s", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package nfs
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/utils/mount"
+)
+
+// volumeContextNFSVersion is the volume context key of the nfs version the
+// controller negotiated with the server of a volume.
+const volumeContextNFSVersion = "nfsVersion"
+
+// versionNegotiator mounts nfs exports trying the versions of a preference
+// list in order and remembers the version every server accepted, so that
+// later mounts of the same server try it first.
+type versionNegotiator struct {
+	mu         sync.Mutex
+	preference []string
+	// versions maps a server to the version it last accepted
+	versions map[string]string
+}
+
+func newVersionNegotiator(preference []string) *versionNegotiator {
+	return &versionNegotiator{
+		preference: preference,
+		versions:   make(map[string]string),
+	}
+}
+
+// parseNFSVersions parses a comma separated nfs version preference list.
+func parseNFSVersions(s string) ([]string, error) {
+	versions := splitMountOptions(s)
+	for _, v := range versions {
+		if err := mountOptionValidators["vers"](v); err != nil {
+			return nil, fmt.Errorf("invalid nfs version %q: %s", v, err)
+		}
+	}
+	return versions, nil
+}
+
+// enabled reports whether versions are negotiated at all.
+func (n *versionNegotiator) enabled() bool {
+	return len(n.preference) > 0
+}
+
+// version returns the version server last accepted, if any.
+func (n *versionNegotiator) version(server string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.versions[server]
+}
+
+// mount mounts the export source of server at target. Options setting the
+// version explicitly are used as they are, otherwise the version server
+// accepted last, then hint and then the preference list are tried until one
+// is not refused by the server. It returns the version which was mounted,
+// empty when nothing was negotiated.
+func (n *versionNegotiator) mount(mounter mount.Interface, server, source, target string, options []string, hint string) (string, error) {
+	if !n.enabled() || hasVersion(options) {
+		return "", mounter.Mount(source, target, "nfs", options)
+	}
+
+	var err error
+	for _, v := range n.candidates(server, hint) {
+		mo := append(append([]string(nil), options...), "vers="+v)
+		err = mounter.Mount(source, target, "nfs", mo)
+		if err == nil {
+			n.mu.Lock()
+			if n.versions[server] != v {
+				logrus.Infof("negotiated nfs version %s with server %s", v, server)
+			}
+			n.versions[server] = v
+			n.mu.Unlock()
+			return v, nil
+		}
+		if !versionRefused(err) {
+			break
+		}
+		logrus.Warnf("nfs server %s refused version %s: %s", server, v, err)
+	}
+
+	n.mu.Lock()
+	delete(n.versions, server)
+	n.mu.Unlock()
+	return "", err
+}
+
+// candidates returns the versions of the preference list to try for server
+// in order, the version server accepted last and the hint first.
+func (n *versionNegotiator) candidates(server, hint string) []string {
+	preferred := make(map[string]bool, len(n.preference))
+	for _, v := range n.preference {
+		preferred[v] = true
+	}
+
+	var candidates []string
+	seen := make(map[string]bool)
+	for _, v := range append([]string{n.version(server), hint}, n.preference...) {
+		if !preferred[v] || seen[v] {
+			continue
+		}
+		seen[v] = true
+		candidates = append(candidates, v)
+	}
+	return candidates
+}
+
+// hasVersion reports whether options set the nfs version explicitly.
+func hasVersion(options []string) bool {
+	return len(withoutVersion(options)) != len(options)
+}
+
+// withoutVersion returns options without the nfs version.
+func withoutVersion(options []string) []string {
+	var out []string
+	for _, o := range options {
+		if mountOptionKey(o) != "vers" {
+			out = append(out, o)
+		}
+	}
+	return out
+}
+
+// versionRefused reports whether a mount error means the server does not
+// speak the requested version, as opposed to any other mount failure.
+func versionRefused(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"not supported", "program not registered", "program version", "protocol not supported"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
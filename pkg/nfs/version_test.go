@@ -0,0 +1,34 @@
+package nfs
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCandidates(t *testing.T) {
+	tests := []struct {
+		preference []string
+		accepted   string
+		hint       string
+		want       []string
+	}{
+		{preference: nil, hint: "4.1", want: nil},
+		{preference: []string{"4.2", "4.1", "3"}, want: []string{"4.2", "4.1", "3"}},
+		{preference: []string{"4.2", "4.1", "3"}, hint: "3", want: []string{"3", "4.2", "4.1"}},
+		{preference: []string{"4.2", "4.1", "3"}, accepted: "4.1", want: []string{"4.1", "4.2", "3"}},
+		{preference: []string{"4.2", "4.1", "3"}, accepted: "4.1", hint: "3", want: []string{"4.1", "3", "4.2"}},
+		{preference: []string{"4.2", "4.1", "3"}, accepted: "3", hint: "3", want: []string{"3", "4.2", "4.1"}},
+		// versions outside of the preference list are never tried
+		{preference: []string{"4.2", "4.1"}, accepted: "4.0", hint: "3", want: []string{"4.2", "4.1"}},
+	}
+	for _, tt := range tests {
+		n := newVersionNegotiator(tt.preference)
+		if tt.accepted != "" {
+			n.versions["nfs.local"] = tt.accepted
+		}
+		got := n.candidates("nfs.local", tt.hint)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("candidates with preference %q, accepted %q and hint %q = %q, want %q", tt.preference, tt.accepted, tt.hint, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package nfs
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// volumeIDVersion is the first field of every volume and snapshot id
+	// created by this driver, bump it when the layout of the id changes.
+	volumeIDVersion   = "v1"
+	volumeIDSeparator = "#"
+	// volumeIDStatic is the optional last field of the ids of volumes
+	// imported from existing directories, which are never deleted.
+	volumeIDStatic = "static"
+	// volumeIDSnapshot marks the ids of read-only snapshot volumes, it is
+	// followed by the name of the volume since all the volumes of a
+	// snapshot share its extracted directory.
+	volumeIDSnapshot = "snapshot"
+	// volumeIDMountOptions prefixes the optional last field of the ids
+	// of volumes created with the mountOptions StorageClass parameter, the
+	// controller mounts their export with them.
+	volumeIDMountOptions = "mountOptions="
+)
+
+// nfsVolume describes where a volume lives: the directory subDir
+// under the export server:share.
+type nfsVolume struct {
+	id     string
+	server string
+	share  string
+	subDir string
+	// static volumes are pre-provisioned and never deleted by the driver
+	static bool
+	// snapshotRef is the name of a read-only snapshot volume, whose subDir
+	// is the extracted snapshot under the snapshot directory share
+	snapshotRef string
+	// mountOptions are the options the controller mounts the export with,
+	// the options of its backend or of the controller when empty
+	mountOptions string
+}
+
+// nfsSnapshot describes where a snapshot lives: the archive name under
+// the snapshot directory of the export server:share.
+type nfsSnapshot struct {
+	id     string
+	server string
+	share  string
+	name   string
+	// mountOptions are those of the source volume
+	mountOptions string
+}
+
+// newNFSVolume builds a volume and its self-describing id, the id
+// has the form "v1#server#share#subDir".
+func newNFSVolume(server, share, subDir string) *nfsVolume {
+	vol := &nfsVolume{
+		server: server,
+		share:  filepath.Clean(share),
+		subDir: subDir,
+	}
+	vol.id = encodeID(vol.server, vol.share, vol.subDir)
+	return vol
+}
+
+// newNFSVolumeWithOptions builds a volume whose export the controller
+// mounts with mountOptions, its id has the form
+// "v1#server#share#subDir#mountOptions=options" when they are not empty.
+func newNFSVolumeWithOptions(server, share, subDir, mountOptions string) *nfsVolume {
+	vol := newNFSVolume(server, share, subDir)
+	vol.mountOptions = mountOptions
+	vol.id = encodeID(vol.server, vol.share, vol.subDir, mountOptionsField(mountOptions)...)
+	return vol
+}
+
+// newStaticNFSVolume builds a pre-provisioned volume for the existing
+// directory subDir, its id has the form "v1#server#share#subDir#static".
+func newStaticNFSVolume(server, share, subDir string) *nfsVolume {
+	vol := newNFSVolume(server, share, subDir)
+	vol.static = true
+	vol.id = encodeID(vol.server, vol.share, vol.subDir, volumeIDStatic)
+	return vol
+}
+
+// newSnapshotNFSVolume builds the read-only volume name of the snapshot
+// snap, extracted at the directory snap.name of the snapshot directory
+// snapDir. Its id has the form "v1#server#snapDir#snapshot-name#snapshot#name".
+func newSnapshotNFSVolume(snap *nfsSnapshot, snapDir, name string) *nfsVolume {
+	vol := newNFSVolume(snap.server, filepath.Join(snap.share, snapDir), snap.name)
+	vol.snapshotRef = name
+	vol.mountOptions = snap.mountOptions
+	vol.id = encodeID(vol.server, vol.share, vol.subDir, append([]string{volumeIDSnapshot, name}, mountOptionsField(snap.mountOptions)...)...)
+	return vol
+}
+
+// newNFSSnapshot builds a snapshot stored on the export of vol, its id
+// has the same layout as volume ids.
+func newNFSSnapshot(vol *nfsVolume, name string) *nfsSnapshot {
+	snap := &nfsSnapshot{
+		server:       vol.server,
+		share:        vol.share,
+		name:         name,
+		mountOptions: vol.mountOptions,
+	}
+	snap.id = encodeID(snap.server, snap.share, snap.name, mountOptionsField(vol.mountOptions)...)
+	return snap
+}
+
+// parseVolumeID decodes a volume id created by newNFSVolume. Legacy ids
+// are the bare volume name, they are resolved against the server and
+// share point the driver has been started with.
+func (n *nfsDriver) parseVolumeID(id string) (*nfsVolume, error) {
+	vol, err := n.decodeID(id)
+	if err != nil {
+		return nil, fmt.Errorf("volume %s", err)
+	}
+	return vol, nil
+}
+
+// parseSnapshotID decodes a snapshot id created by newNFSSnapshot, legacy
+// ids are resolved like legacy volume ids.
+func (n *nfsDriver) parseSnapshotID(id string) (*nfsSnapshot, error) {
+	vol, err := n.decodeID(id)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s", err)
+	}
+	if vol.static || vol.snapshotRef != "" {
+		return nil, fmt.Errorf("snapshot id %q is malformed", id)
+	}
+	return &nfsSnapshot{
+		id:           id,
+		server:       vol.server,
+		share:        vol.share,
+		name:         vol.subDir,
+		mountOptions: vol.mountOptions,
+	}, nil
+}
+
+func encodeID(server, share, name string, flags ...string) string {
+	fields := append([]string{volumeIDVersion, server, share, name}, flags...)
+	return strings.Join(fields, volumeIDSeparator)
+}
+
+// mountOptionsField returns the id field carrying mountOptions, none when
+// they are empty.
+func mountOptionsField(mountOptions string) []string {
+	if mountOptions == "" {
+		return nil
+	}
+	return []string{volumeIDMountOptions + mountOptions}
+}
+
+func (n *nfsDriver) decodeID(id string) (*nfsVolume, error) {
+	if err := validateID(id); err != nil {
+		return nil, err
+	}
+
+	if !strings.Contains(id, volumeIDSeparator) {
+		if err := validateName(id); err != nil {
+			return nil, fmt.Errorf("id %q is invalid: %s", id, err)
+		}
+		return &nfsVolume{
+			id:     id,
+			server: n.nfsServer,
+			share:  filepath.Clean(n.nfsSharePoint),
+			subDir: id,
+		}, nil
+	}
+
+	vol := &nfsVolume{id: id}
+	fields := strings.Split(id, volumeIDSeparator)
+	if fields[0] != volumeIDVersion {
+		return nil, fmt.Errorf("id %q has unsupported version %q", id, fields[0])
+	}
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("id %q is malformed", id)
+	}
+	flags := fields[4:]
+	fields = fields[:4]
+	if n := len(flags); n > 0 && strings.HasPrefix(flags[n-1], volumeIDMountOptions) {
+		vol.mountOptions = strings.TrimPrefix(flags[n-1], volumeIDMountOptions)
+		if err := validateMountOptions(splitMountOptions(vol.mountOptions)); err != nil {
+			return nil, fmt.Errorf("id %q is invalid: %s", id, err)
+		}
+		flags = flags[:n-1]
+	}
+	switch {
+	case len(flags) == 0:
+	case len(flags) == 1 && flags[0] == volumeIDStatic:
+		vol.static = true
+	case len(flags) == 2 && flags[0] == volumeIDSnapshot:
+		if err := validateName(flags[1]); err != nil {
+			return nil, fmt.Errorf("id %q is invalid: %s", id, err)
+		}
+		vol.snapshotRef = flags[1]
+	default:
+		return nil, fmt.Errorf("id %q is malformed", id)
+	}
+	if err := validateServer(fields[1]); err != nil {
+		return nil, fmt.Errorf("id %q is invalid: %s", id, err)
+	}
+	if err := validateShare(fields[2]); err != nil {
+		return nil, fmt.Errorf("id %q is invalid: %s", id, err)
+	}
+	if err := validateName(fields[3]); err != nil {
+		return nil, fmt.Errorf("id %q is invalid: %s", id, err)
+	}
+	vol.server, vol.share, vol.subDir = fields[1], filepath.Clean(fields[2]), fields[3]
+	return vol, nil
+}
+
+// exportShare returns the share of the export vol lives on, read-only
+// snapshot volumes live in the snapshot directory snapDir of their export.
+func (v *nfsVolume) exportShare(snapDir string) string {
+	if v.snapshotRef == "" {
+		return v.share
+	}
+	return filepath.Clean(strings.TrimSuffix(v.share, strings.Trim(filepath.Clean(snapDir), "/")))
+}
+
+// source returns the nfs source a node should mount for this volume.
+func (v *nfsVolume) source() string {
+	return fmt.Sprintf("%s:%s", v.server, filepath.Join(v.share, v.subDir))
+}
+
+func (v *nfsVolume) String() string {
+	return v.source()
+}
@@ -0,0 +1,72 @@
+package nfs
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeID(t *testing.T) {
+	n := &nfsDriver{nfsServer: "10.0.0.1", nfsSharePoint: "/export/"}
+	tests := []struct {
+		id   string
+		want *nfsVolume
+		err  bool
+	}{
+		{id: "pvc-1", want: &nfsVolume{server: "10.0.0.1", share: "/export", subDir: "pvc-1"}},
+		{id: "v1#nfs.local#/data#pvc-1", want: &nfsVolume{server: "nfs.local", share: "/data", subDir: "pvc-1"}},
+		{id: "v1#nfs.local#/data/#pvc-1", want: &nfsVolume{server: "nfs.local", share: "/data", subDir: "pvc-1"}},
+		{id: "v1#nfs.local#/data#pvc-1#static", want: &nfsVolume{server: "nfs.local", share: "/data", subDir: "pvc-1", static: true}},
+		{id: "v1#nfs.local#/data/snapshot#snap-1#snapshot#pvc-2", want: &nfsVolume{server: "nfs.local", share: "/data/snapshot", subDir: "snap-1", snapshotRef: "pvc-2"}},
+		{id: "v1#nfs.local#/data#pvc-1#mountOptions=vers=4.1,hard", want: &nfsVolume{server: "nfs.local", share: "/data", subDir: "pvc-1", mountOptions: "vers=4.1,hard"}},
+		{id: "v1#nfs.local#/data#pvc-1#static#mountOptions=nolock", want: &nfsVolume{server: "nfs.local", share: "/data", subDir: "pvc-1", static: true, mountOptions: "nolock"}},
+		{id: "", err: true},
+		{id: strings.Repeat("a", maxIDLength+1), err: true},
+		{id: "a/b", err: true},
+		{id: "..", err: true},
+		{id: "v2#nfs.local#/data#pvc-1", err: true},
+		{id: "v1#nfs.local#/data", err: true},
+		{id: "v1##/data#pvc-1", err: true},
+		{id: "v1#nfs.local#data#pvc-1", err: true},
+		{id: "v1#nfs.local#/data/../etc#pvc-1", err: true},
+		{id: "v1#nfs.local#/data#..", err: true},
+		{id: "v1#nfs.local#/data#pvc-1#bogus", err: true},
+		{id: "v1#nfs.local#/data#pvc-1#static#static", err: true},
+		{id: "v1#nfs.local#/data#snap-1#snapshot", err: true},
+		{id: "v1#nfs.local#/data#snap-1#snapshot#..", err: true},
+		{id: "v1#nfs.local#/data#pvc-1#mountOptions=suid", err: true},
+		{id: "v1#nfs.local#/data#pvc-1#mountOptions=vers=4.1#static", err: true},
+	}
+	for _, tt := range tests {
+		got, err := n.decodeID(tt.id)
+		if tt.err {
+			if err == nil {
+				t.Errorf("decodeID(%q) = %+v, want an error", tt.id, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("decodeID(%q) failed: %s", tt.id, err)
+			continue
+		}
+		tt.want.id = tt.id
+		if *got != *tt.want {
+			t.Errorf("decodeID(%q) = %+v, want %+v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestSnapshotIDRoundTrip(t *testing.T) {
+	n := &nfsDriver{}
+	vol := newNFSVolumeWithOptions("nfs.local", "/data", "pvc-1", "vers=4.2")
+	snap := newNFSSnapshot(vol, "snap-1")
+	got, err := n.parseSnapshotID(snap.id)
+	if err != nil {
+		t.Fatalf("parseSnapshotID(%q) failed: %s", snap.id, err)
+	}
+	if *got != *snap {
+		t.Errorf("parseSnapshotID(%q) = %+v, want %+v", snap.id, got, snap)
+	}
+	if _, err := n.parseSnapshotID(encodeID("nfs.local", "/data", "pvc-1", volumeIDStatic)); err == nil {
+		t.Errorf("parseSnapshotID accepted a static volume id")
+	}
+}